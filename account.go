@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/scorredoira/email"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Local accounts can be used without Strava when serverConf.LocalAccounts
+//is true.  They are in the same uid space as the Strava users, so all the
+//handlers work with them.  They can only use the uploaded tracks.
+
+const web_register = "register"
+const web_locallogin = "locallogin"
+const web_verify = "verify"
+
+//Time that the verification email can be used
+const localVerifyAge = 24 * time.Hour
+
+//Time that must pass before the verification email is sent again
+const localVerifyResend = 10 * time.Minute
+
+//bcrypt only uses the first 72 bytes
+const localPasswordMin = 8
+const localPasswordMax = 72
+
+var localUsernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+//Compared when the username doesn't exist, then the time of the reply
+//doesn't tell if the username is used
+var localDummyHash []byte
+
+func accountInit() {
+	if !serverConf.LocalAccounts {
+		return
+	}
+	if serverConf.SmtpServer == "" {
+		fatal("If 'LocalAccounts' is true, field 'SmtpServer' is required to verify the email")
+	}
+
+	var err error
+	if localDummyHash, err = bcrypt.GenerateFromPassword([]byte("gps2video"), bcrypt.DefaultCost); err != nil {
+		fatal("accountInit bcrypt.GenerateFromPassword", "err", err)
+	}
+
+	httpHandleFunc(serverConf.DomainDir+web_register, "register", registerHandler)
+	httpHandleFunc(serverConf.DomainDir+web_locallogin, "locallogin", localLoginHandler)
+	httpHandleFunc(serverConf.DomainDir+web_verify, "verify", verifyHandler)
+}
+
+//Return a new verification token and its hash that is kept in the user
+//record
+func newVerifyToken() (token string, hash string, err error) {
+	if token, err = randomHex(32); err != nil {
+		return
+	}
+	hash = verifyTokenHash(token)
+	return
+}
+
+func verifyTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//Send the verification email of the local account uid to address
+func sendVerifyMail(uid uint64, address string, token string) (err error) {
+	outcome := "fail"
+	defer func() {
+		metricEmails.WithLabelValues(outcome).Inc()
+	}()
+
+	link := fmt.Sprintf("%s%s?uid=%d&token=%s", baseURL, web_verify, uid, url.QueryEscape(token))
+	m := email.NewMessage("GPS2Video邮箱验证", fmt.Sprintf("请在%d小时内打开下面的链接验证邮箱:\n%s", int(localVerifyAge/time.Hour), link))
+	m.From = mail.Address{Name: "GPS2Video", Address: serverConf.SmtpEmail}
+	m.To = []string{address}
+
+	auth := smtp.PlainAuth("", serverConf.SmtpEmail, serverConf.SmtpPassword, serverConf.SmtpServer)
+	if err = email.Send(fmt.Sprintf("%s:%d", serverConf.SmtpServer, serverConf.SmtpPort), auth, m); err != nil {
+		return
+	}
+	outcome = "sent"
+	return
+}
+
+//Check the form of registerHandler.  The error can be shown to the user.
+func registerCheck(r *http.Request) (username string, address string, password string, err error) {
+	username = r.PostFormValue("username")
+	if !localUsernameRegexp.MatchString(username) {
+		err = errors.New("用户名只能使用3到32个字母、数字、“_”、“.”和“-”")
+		return
+	}
+
+	addr, e := mail.ParseAddress(r.PostFormValue("email"))
+	if e != nil {
+		err = errors.New("邮箱格式不正确")
+		return
+	}
+	address = addr.Address
+
+	password = r.PostFormValue("password")
+	if len(password) < localPasswordMin || len(password) > localPasswordMax {
+		err = fmt.Errorf("密码的长度需要在%d到%d之间", localPasswordMin, localPasswordMax)
+		return
+	}
+	if password != r.PostFormValue("password2") {
+		err = errors.New("两次输入的密码不一样")
+		return
+	}
+	return
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	lg := httpLogger(r, 0)
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		if !sessions.CheckPreCSRF(r) {
+			httpCSRFError(w)
+			return
+		}
+		username, address, password, err := registerCheck(r)
+		if err != nil {
+			httpShowError(w, err.Error())
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			lg.Error("registerHandler bcrypt.GenerateFromPassword", "err", err)
+			httpShowError(w, "系统出错:"+err.Error())
+			return
+		}
+		token, verify_hash, err := newVerifyToken()
+		if err != nil {
+			lg.Error("registerHandler newVerifyToken", "err", err)
+			httpShowError(w, "系统出错:"+err.Error())
+			return
+		}
+		uid, err := users.AddLocal(username, address, string(hash), verify_hash)
+		if err != nil {
+			lg.Warn("registerHandler users.AddLocal", "username", username, "err", err)
+			httpShowError(w, "注册出错:"+err.Error())
+			return
+		}
+		lg = lg.With("uid", uid)
+		lg.Info("registerHandler add local account", "username", username)
+
+		if err = sendVerifyMail(uid, address, token); err != nil {
+			lg.Error("registerHandler sendVerifyMail", "err", err)
+			httpReturnHome(w, fmt.Sprintf("注册成功，但是发送验证邮件出错，请%d分钟后登陆以重新发送", int(localVerifyResend/time.Minute)))
+			return
+		}
+		httpReturnHome(w, "注册成功，请打开验证邮件中的链接")
+		return
+	}
+
+	sid, err := sessions.PreSession(w, r)
+	if err != nil {
+		lg.Error("registerHandler sessions.PreSession", "err", err)
+		httpShowError(w, "系统出错:"+err.Error())
+		return
+	}
+	httpHead(w)
+	show := `<a href="` + serverConf.DomainDir + `">返回</a><hr>`
+	show += `<form action="` + serverConf.DomainDir + web_register + `" method="post">`
+	show += csrfInput(sid)
+	show += `用户名<br><input type="text" name="username"><br>`
+	show += `邮箱<br><input type="email" name="email"><br>`
+	show += fmt.Sprintf(`密码(%d到%d个字符)<br><input type="password" name="password"><br>`, localPasswordMin, localPasswordMax)
+	show += `再次输入密码<br><input type="password" name="password2"><br><br>`
+	show += `<input type="submit" value="注册" /></form>`
+	fmt.Fprintln(w, show)
+	httpTail(w)
+}
+
+//The login page of the local accounts.  It is shown by loginHandler.
+func localLoginPage(w http.ResponseWriter, r *http.Request, next string) {
+	sid, err := sessions.PreSession(w, r)
+	if err != nil {
+		httpLogger(r, 0).Error("localLoginPage sessions.PreSession", "err", err)
+		httpShowError(w, "系统出错:"+err.Error())
+		return
+	}
+	httpHead(w)
+	show := fmt.Sprintf(`<a href="%s?strava=1&next=%s">访问Strava登陆</a><hr>`,
+		serverConf.DomainDir+web_login, url.QueryEscape(next))
+	show += `<form action="` + serverConf.DomainDir + web_locallogin + `" method="post">`
+	show += csrfInput(sid)
+	show += `<input type="hidden" name="next" value="` + html.EscapeString(next) + `">`
+	show += `用户名<br><input type="text" name="username"><br>`
+	show += `密码<br><input type="password" name="password"><br><br>`
+	show += `<input type="submit" value="登陆" /></form>`
+	show += `<a href="` + serverConf.DomainDir + web_register + `">注册本地账号</a>`
+	fmt.Fprintln(w, show)
+	httpTail(w)
+}
+
+func localLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, serverConf.DomainDir+web_login, http.StatusFound)
+		return
+	}
+	lg := httpLogger(r, 0)
+
+	r.ParseForm()
+	if !sessions.CheckPreCSRF(r) {
+		httpCSRFError(w)
+		return
+	}
+	username := r.PostFormValue("username")
+	next := r.PostFormValue("next")
+	if !loginNextCheck(next) {
+		next = ""
+	}
+
+	uid, hash, address, verified, err := users.GetLocal(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(localDummyHash, []byte(r.PostFormValue("password")))
+		httpShowError(w, err.Error())
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(r.PostFormValue("password"))) != nil {
+		lg.Warn("localLoginHandler password is not right", "uid", uid)
+		httpShowError(w, "用户名或者密码不正确")
+		return
+	}
+	lg = lg.With("uid", uid)
+
+	if !verified {
+		token, verify_hash, err := newVerifyToken()
+		if err == nil {
+			err = users.SetVerifyHash(uid, verify_hash)
+		}
+		if err == nil {
+			err = sendVerifyMail(uid, address, token)
+		}
+		if errors.Is(err, errVerifyResend) {
+			httpShowError(w, "邮箱还没有验证，请打开验证邮件中的链接。"+err.Error())
+			return
+		}
+		if err != nil {
+			lg.Error("localLoginHandler send the verification email", "err", err)
+			httpShowError(w, "邮箱还没有验证，发送验证邮件出错:"+err.Error())
+			return
+		}
+		httpReturnHome(w, "邮箱还没有验证，已经重新发送了验证邮件")
+		return
+	}
+
+	if err = loginSession(w, uid); err != nil {
+		lg.Error("localLoginHandler loginSession", "err", err)
+		httpShowError(w, "登陆出错:"+err.Error())
+		return
+	}
+	lg.Info("localLoginHandler login")
+	if next != "" {
+		http.Redirect(w, r, serverConf.DomainDir+next, http.StatusFound)
+		return
+	}
+	httpReturnHome(w, "登陆成功")
+}
+
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	uid, err := strconv.ParseUint(r.FormValue("uid"), 10, 64)
+	if err != nil {
+		httpShowError(w, "验证链接不正确")
+		return
+	}
+	lg := httpLogger(r, uid)
+
+	if err = users.VerifyEmail(uid, verifyTokenHash(r.FormValue("token"))); err != nil {
+		lg.Warn("verifyHandler users.VerifyEmail", "err", err)
+		httpShowError(w, err.Error())
+		return
+	}
+	lg.Info("verifyHandler email verified")
+
+	//The link in the email is not a password, login with the password
+	http.Redirect(w, r, serverConf.DomainDir+web_login, http.StatusFound)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teawater/go.strava"
+)
+
+//The activities that can be made to video.  The Strava activities are
+//cached for each user, the uploaded tracks are read each time.
+
+//Strava allows at most 200 activities in a page
+const activityPerPage = 200
+
+//Don't get more pages than it from Strava
+const activityMaxPages = 50
+
+//Type of the uploaded tracks
+const activityTypeUpload = "Upload"
+
+type ActivityInfo struct {
+	Id             int64 //Negative for the uploaded tracks
+	Name           string
+	Type           string
+	StartDateLocal time.Time
+	Distance       float64       //Meters
+	Duration       time.Duration //Moving time
+	Elevation      float64       //Meters of the climb
+
+	startDate time.Time //UTC, used to get the older pages from Strava
+}
+
+//Description of a, shown in the activity picker
+func (a *ActivityInfo) Desc() string {
+	return fmt.Sprintf("%s %s %.1fkm %s 爬升%.0fm", a.Name, a.StartDateLocal.Format(activity_layout),
+		a.Distance/1000, activityDuration(a.Duration), a.Elevation)
+}
+
+func activityDuration(d time.Duration) string {
+	secs := int64(d / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+}
+
+//Only the newest page is got from Strava when the page is loaded.  The
+//older pages are got by a goroutine in the background and added to the
+//list page by page.
+type activityList struct {
+	lock sync.Mutex
+
+	activities []ActivityInfo //The newest is the first
+	fetchedAt  time.Time      //When the newest page was got
+
+	fetching  bool  //The goroutine is getting the older pages
+	complete  bool  //All the activities are got
+	truncated bool  //Stopped at activityMaxPages
+	err       error //Why the goroutine stopped
+	stopped   bool  //Removed from the cache, the goroutine should stop
+}
+
+type ActivityCache struct {
+	lock sync.Mutex
+
+	uid2list map[uint64]*activityList
+}
+
+var activityCache = ActivityCache{uid2list: make(map[uint64]*activityList)}
+
+func (c *ActivityCache) list(uid uint64) *activityList {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	list, ok := c.uid2list[uid]
+	if !ok {
+		list = new(activityList)
+		c.uid2list[uid] = list
+	}
+	return list
+}
+
+//Get the Strava activities of uid.  The newest page is got from Strava
+//again if the cache is older than serverConf.ActivityCacheSecs.  note is
+//not empty if the list is not complete, it can be shown to the user.
+//err is only returned when no activity is got.
+func (c *ActivityCache) Get(uid uint64, token string) (activities []ActivityInfo, note string, err error) {
+	list := c.list(uid)
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if list.fetchedAt.IsZero() || time.Since(list.fetchedAt) >= time.Duration(serverConf.ActivityCacheSecs)*time.Second {
+		page, e := stravaActivitiesPage(token, time.Time{})
+		if e != nil {
+			if list.activities == nil {
+				err = e
+				return
+			}
+			slog.Warn("ActivityCache Get stravaActivitiesPage", "uid", uid, "err", e)
+			note = "从Strava更新活动列表出错，下面是之前的列表"
+		} else {
+			var complete bool
+			list.activities, complete = activitiesRefresh(list.activities, page)
+			list.complete = list.complete || complete
+			list.fetchedAt = time.Now()
+		}
+		if !list.complete && !list.fetching && !list.truncated {
+			list.fetching = true
+			list.err = nil
+			go list.fetchOlder(uid, token)
+		}
+	}
+
+	switch {
+	case note != "":
+	case list.fetching:
+		note = "正在从Strava获取更早的活动，请稍后刷新页面"
+	case list.err != nil:
+		note = "从Strava获取更早的活动出错，请稍后刷新页面"
+	case list.truncated:
+		note = fmt.Sprintf("只列出了最近的%d个Strava活动", len(list.activities))
+	}
+	//The caller cannot change the list by append
+	activities = list.activities[:len(list.activities):len(list.activities)]
+	return
+}
+
+//Get the older pages from Strava and add them to list
+func (list *activityList) fetchOlder(uid uint64, token string) {
+	for {
+		list.lock.Lock()
+		if list.stopped {
+			list.fetching = false
+			list.lock.Unlock()
+			return
+		}
+		if len(list.activities) >= activityPerPage*activityMaxPages {
+			list.truncated = true
+			list.fetching = false
+			list.lock.Unlock()
+			return
+		}
+		var before time.Time
+		if n := len(list.activities); n > 0 {
+			before = list.activities[n-1].startDate
+		}
+		list.lock.Unlock()
+
+		page, err := stravaActivitiesPage(token, before)
+
+		list.lock.Lock()
+		if err != nil {
+			slog.Warn("activityList fetchOlder stravaActivitiesPage", "uid", uid, "err", err)
+			list.err = err
+			list.fetching = false
+			list.lock.Unlock()
+			return
+		}
+		var added int
+		list.activities, added = activitiesAppend(list.activities, page)
+		if len(page) < activityPerPage || added == 0 {
+			list.complete = true
+			list.fetching = false
+			list.lock.Unlock()
+			return
+		}
+		list.lock.Unlock()
+	}
+}
+
+//Get the newest page from Strava again next time
+func (c *ActivityCache) Refresh(uid uint64) {
+	list := c.list(uid)
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.fetchedAt = time.Time{}
+}
+
+//Remove the cache of uid, then it will be got from Strava next time
+func (c *ActivityCache) Delete(uid uint64) {
+	c.lock.Lock()
+	list, ok := c.uid2list[uid]
+	delete(c.uid2list, uid)
+	c.lock.Unlock()
+
+	if ok {
+		list.lock.Lock()
+		list.stopped = true
+		list.lock.Unlock()
+	}
+}
+
+//Put the newest page in front of the old list.  The old activities that
+//are in the time of page are removed, then the deleted ones are gone.
+//complete is true if page has all the activities.
+func activitiesRefresh(old []ActivityInfo, page []ActivityInfo) (activities []ActivityInfo, complete bool) {
+	activities = append(make([]ActivityInfo, 0, len(page)), page...)
+	if len(page) < activityPerPage {
+		complete = true
+		return
+	}
+
+	oldest := page[len(page)-1].startDate
+	ids := make(map[int64]bool)
+	for _, activity := range page {
+		ids[activity.Id] = true
+	}
+	for _, activity := range old {
+		if activity.startDate.Before(oldest) && !ids[activity.Id] {
+			activities = append(activities, activity)
+		}
+	}
+	return
+}
+
+//Add the older page to the end of the list.  The activities that are
+//already in the list are not added.
+func activitiesAppend(old []ActivityInfo, page []ActivityInfo) (activities []ActivityInfo, added int) {
+	activities = old
+	ids := make(map[int64]bool)
+	for _, activity := range old {
+		ids[activity.Id] = true
+	}
+	for _, activity := range page {
+		if !ids[activity.Id] {
+			activities = append(activities, activity)
+			added++
+		}
+	}
+	return
+}
+
+//Get a page of the activities from Strava that started before before.
+//Zero before means the newest page.
+func stravaActivitiesPage(token string, before time.Time) (activities []ActivityInfo, err error) {
+	service := strava.NewCurrentAthleteService(strava.NewClient(token, stravaHTTPClient))
+	call := service.ListActivities().PerPage(activityPerPage)
+	if !before.IsZero() {
+		//The activities that started in the same second are not lost,
+		//the ones that are already got are removed by activitiesAppend
+		call = call.Before(int(before.Unix() + 1))
+	}
+	summaries, err := call.Do()
+	if err != nil {
+		return
+	}
+	activities = make([]ActivityInfo, 0, len(summaries))
+	for _, activity := range summaries {
+		activities = append(activities, ActivityInfo{
+			Id:             activity.Id,
+			Name:           activity.Name,
+			Type:           string(activity.Type),
+			StartDateLocal: activity.StartDateLocal,
+			Distance:       activity.Distance,
+			Duration:       time.Duration(activity.MovingTime) * time.Second,
+			Elevation:      activity.TotalElevationGain,
+			startDate:      activity.StartDate,
+		})
+	}
+	return
+}
+
+//The Strava activities and the uploaded tracks of uid, the newest is the
+//first.  The error and note can be shown to the user, note is not empty
+//if the Strava activities are not complete.
+func listActivities(uid uint64) (activities []ActivityInfo, note string, err error) {
+	//The local accounts don't have the token
+	token, err := users.GetToken(uid)
+	if err != nil && err != errNoStrava {
+		return
+	}
+	if token != "" {
+		var strava_activities []ActivityInfo
+		if strava_activities, note, err = activityCache.Get(uid, token); err != nil {
+			err = fmt.Errorf("strava出错:%s", err)
+			return
+		}
+		activities = append(activities, strava_activities...)
+	}
+
+	tracks, err := listTracks(uid)
+	if err != nil {
+		err = fmt.Errorf("读取上传的轨迹出错:%s", err)
+		return
+	}
+	for _, track := range tracks {
+		activities = append(activities, ActivityInfo{
+			Id:             track.Id,
+			Name:           track.Name,
+			Type:           activityTypeUpload,
+			StartDateLocal: track.Start.Local(),
+			Distance:       track.Distance,
+			Duration:       track.Duration,
+			Elevation:      track.Elevation,
+		})
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].StartDateLocal.After(activities[j].StartDateLocal)
+	})
+	return
+}
+
+type ActivityFilter struct {
+	Type   string    //Empty means all
+	After  time.Time //Zero means no limit
+	Before time.Time //Zero means no limit
+	Name   string    //Part of the name, case insensitive
+}
+
+func (f *ActivityFilter) Match(a *ActivityInfo) bool {
+	if f.Type != "" && !strings.EqualFold(f.Type, a.Type) {
+		return false
+	}
+	if !f.After.IsZero() && a.StartDateLocal.Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !a.StartDateLocal.Before(f.Before) {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(a.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	return true
+}
+
+func filterActivities(activities []ActivityInfo, f *ActivityFilter) (ret []ActivityInfo) {
+	ret = make([]ActivityInfo, 0)
+	for i := range activities {
+		if f.Match(&activities[i]) {
+			ret = append(ret, activities[i])
+		}
+	}
+	return
+}
+
+//The HTML of the activity picker.  The activities are filtered by the
+//JavaScript in the browser, so all of them are in the select.
+func activityPickerHtml(index string, activities []ActivityInfo) (show string) {
+	types := make([]string, 0)
+	type_exist := make(map[string]bool)
+	for _, activity := range activities {
+		if !type_exist[activity.Type] {
+			type_exist[activity.Type] = true
+			types = append(types, activity.Type)
+		}
+	}
+	sort.Strings(types)
+
+	show += `类型 <select id="activity_type" onchange="activityFilter()"><option value="">全部</option>`
+	for _, t := range types {
+		show += `<option value="` + html.EscapeString(t) + `">` + html.EscapeString(t) + `</option>`
+	}
+	show += `</select> `
+	show += `从 <input type="date" id="activity_after" onchange="activityFilter()"> `
+	show += `到 <input type="date" id="activity_before" onchange="activityFilter()"> `
+	show += `名称 <input type="text" id="activity_name" oninput="activityFilter()"> `
+	show += fmt.Sprintf(`<span id="activity_count">%d</span>个<br>`, len(activities))
+
+	show += `<select name="` + index + `" id="activity_select" size="15">`
+	for i, activity := range activities {
+		selected := ""
+		if i == 0 {
+			selected = ` selected="selected"`
+		}
+		show += fmt.Sprintf(`<option value="%d" data-type="%s" data-date="%s" data-name="%s"%s>`,
+			activity.Id, html.EscapeString(activity.Type), activity.StartDateLocal.Format("2006-01-02"),
+			html.EscapeString(strings.ToLower(activity.Name)), selected)
+		if activity.Type == activityTypeUpload {
+			show += `[上传] `
+		}
+		show += html.EscapeString(activity.Desc()) + `</option>`
+	}
+	show += `</select>`
+
+	show += `<script>
+	function activityFilter() {
+		var type = document.getElementById('activity_type').value;
+		var after = document.getElementById('activity_after').value;
+		var before = document.getElementById('activity_before').value;
+		var name = document.getElementById('activity_name').value.toLowerCase();
+		var select = document.getElementById('activity_select');
+		var shown = 0;
+		var first = -1;
+		for (var i = 0; i < select.options.length; i++) {
+			var option = select.options[i];
+			var date = option.getAttribute('data-date');
+			var show = (type == '' || option.getAttribute('data-type') == type) &&
+				(after == '' || date >= after) &&
+				(before == '' || date <= before) &&
+				(name == '' || option.getAttribute('data-name').indexOf(name) >= 0);
+			option.hidden = !show;
+			option.disabled = !show;
+			if (show) {
+				shown++;
+				if (first < 0)
+					first = i;
+			}
+		}
+		if (select.selectedIndex < 0 || select.options[select.selectedIndex].disabled)
+			select.selectedIndex = first;
+		document.getElementById('activity_count').innerHTML = shown;
+	}
+	</script>`
+	return
+}
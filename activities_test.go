@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//Activities with ids from first to last, the bigger id is newer
+func testActivities(first int64, last int64) (activities []ActivityInfo) {
+	base := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	step := int64(1)
+	if first > last {
+		step = -1
+	}
+	for id := first; ; id += step {
+		activities = append(activities, ActivityInfo{Id: id, startDate: base.Add(time.Duration(id) * time.Hour)})
+		if id == last {
+			break
+		}
+	}
+	return
+}
+
+func testActivityIds(activities []ActivityInfo) (ids []int64) {
+	for _, activity := range activities {
+		ids = append(ids, activity.Id)
+	}
+	return
+}
+
+func testSameIds(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestActivitiesRefresh(t *testing.T) {
+	full := testActivities(1000, 1000-activityPerPage+1)
+	//The activity 990 is deleted
+	deleted := append(testActivities(1001, 991), testActivities(989, 989-activityPerPage+12)...)
+
+	tests := []struct {
+		name     string
+		old      []ActivityInfo
+		page     []ActivityInfo
+		want     []ActivityInfo
+		complete bool
+	}{
+		{"first time", nil, full, full, false},
+		{"less than a page", testActivities(10, 1), testActivities(12, 3), testActivities(12, 3), true},
+		{"keep the older", testActivities(1000, 1), full, testActivities(1000, 1), false},
+		{"new activity", testActivities(1000, 1), testActivities(1001, 1000-activityPerPage+2),
+			testActivities(1001, 1), false},
+		{"deleted activity", testActivities(1000, 1), deleted,
+			append(deleted, testActivities(989-activityPerPage+11, 1)...), false},
+	}
+	for _, test := range tests {
+		got, complete := activitiesRefresh(test.old, test.page)
+		if !testSameIds(testActivityIds(got), testActivityIds(test.want)) || complete != test.complete {
+			t.Errorf("%s: activitiesRefresh = %d activities, %v, want %d, %v",
+				test.name, len(got), complete, len(test.want), test.complete)
+		}
+	}
+}
+
+func TestActivitiesAppend(t *testing.T) {
+	tests := []struct {
+		name  string
+		old   []ActivityInfo
+		page  []ActivityInfo
+		want  []ActivityInfo
+		added int
+	}{
+		{"empty", nil, testActivities(3, 1), testActivities(3, 1), 3},
+		{"older", testActivities(6, 4), testActivities(3, 1), testActivities(6, 1), 3},
+		{"same second", testActivities(6, 3), testActivities(3, 1), testActivities(6, 1), 2},
+		{"nothing new", testActivities(6, 3), testActivities(4, 3), testActivities(6, 3), 0},
+		{"empty page", testActivities(6, 3), nil, testActivities(6, 3), 0},
+	}
+	for _, test := range tests {
+		got, added := activitiesAppend(test.old, test.page)
+		if !testSameIds(testActivityIds(got), testActivityIds(test.want)) || added != test.added {
+			t.Errorf("%s: activitiesAppend = %v, %d, want %v, %d",
+				test.name, testActivityIds(got), added, testActivityIds(test.want), test.added)
+		}
+	}
+}
+
+//The goroutine that gets the older pages stops after the cache is deleted
+func TestActivityCacheDelete(t *testing.T) {
+	c := ActivityCache{uid2list: make(map[uint64]*activityList)}
+	list := c.list(1)
+	list.fetching = true
+	c.Delete(1)
+
+	list.fetchOlder(1, "token")
+	if list.fetching || list.complete || list.err != nil {
+		t.Errorf("fetchOlder after Delete: fetching %v, complete %v, err %v", list.fetching, list.complete, list.err)
+	}
+	if c.list(1) == list {
+		t.Error("the list is still in the cache")
+	}
+}
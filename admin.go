@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const web_admin = "admin"
+
+const adminNonceCookie = "admin_nonce"
+
+//The athletes that can access the admin pages
+var adminAthletes = make(map[int64]bool)
+
+func adminInit() {
+	for _, s := range strings.Split(serverConf.AdminAthletes, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			fatal("AdminAthletes is not right", "athlete", s, "err", err)
+		}
+		adminAthletes[id] = true
+	}
+
+	httpHandleFunc(serverConf.DomainDir+web_admin, "admin", adminHandler)
+}
+
+//The user that logged in with an athlete in AdminAthletes or the
+//password AdminPassword of HTTP basic authentication can access the admin
+//pages.  sid is used to get the CSRF token.
+func adminCheck(w http.ResponseWriter, r *http.Request) (sid string, ok bool) {
+	if uid, session_id, err := checkCookie(r); err == nil {
+		if athleteId, err := users.GetAthleteId(uid); err == nil && athleteId != 0 && adminAthletes[athleteId] {
+			return "admin:" + session_id, true
+		}
+	}
+
+	if serverConf.AdminPassword != "" {
+		_, password, basic_ok := r.BasicAuth()
+		if basic_ok && subtle.ConstantTimeCompare([]byte(password), []byte(serverConf.AdminPassword)) == 1 {
+			//The browser sends the password every time, so a random nonce in
+			//the cookie is used as the sid to make the CSRF token unknown to
+			//the other sites.
+			if cookie, err := r.Cookie(adminNonceCookie); err == nil && len(cookie.Value) == 32 {
+				return "admin:basic:" + cookie.Value, true
+			}
+			nonce, err := randomHex(16)
+			if err != nil {
+				httpLogger(r, 0).Error("adminCheck randomHex", "err", err)
+				w.WriteHeader(500)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     adminNonceCookie,
+				Value:    nonce,
+				Path:     serverConf.DomainDir,
+				HttpOnly: true,
+				Secure:   serverConf.SSL,
+				SameSite: http.SameSiteLaxMode,
+			})
+			return "admin:basic:" + nonce, true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="gps2video admin"`)
+		w.WriteHeader(401)
+		return
+	}
+
+	w.WriteHeader(403)
+	return
+}
+
+func adminReturn(w http.ResponseWriter, str string) {
+	httpHead(w)
+	fmt.Fprintln(w, str+"<br>")
+	fmt.Fprintf(w, `<a href="%s">返回</a><br>`, serverConf.DomainDir+web_admin)
+	httpTail(w)
+}
+
+func adminAction(w http.ResponseWriter, r *http.Request, sid string) {
+	if !sessions.CheckCSRF(r, sid) {
+		httpCSRFError(w)
+		return
+	}
+
+	uid, err := strconv.ParseUint(formGetOne(r, "uid"), 10, 64)
+	if err != nil {
+		w.WriteHeader(403)
+		return
+	}
+	action := formGetOne(r, "action")
+	lg := httpLogger(r, uid).With("action", action)
+	lg.Info("admin action")
+
+	switch action {
+	case "cancel":
+		err = jobs.Cancel(uid)
+
+	case "reset":
+		//The status is stuck if there is no job for it
+		var status int
+		if status, err = users.GetUserStatus(uid); err != nil {
+			break
+		}
+		if status != UserMakingVideo && status != UserWaitingVideo {
+			err = fmt.Errorf("状态是%s，不需要重置", userStatusInfo[status])
+			break
+		}
+		if jobs.Busy(uid) {
+			err = fmt.Errorf("视频正在生成或者排队，请使用取消")
+			break
+		}
+		err = users.SetUserStatus(uid, UserMakeVideoFail, nil, &FailInfo{Kind: FailSystem, Reason: "管理员重置了状态"})
+
+	case "delete":
+		err = users.Delete(uid)
+
+	case "rerun":
+		var vid uint64
+		if vid, err = strconv.ParseUint(formGetOne(r, "vid"), 10, 64); err != nil {
+			break
+		}
+		var options MakeVideoOptions
+		if options, err = users.GetRerunOptions(uid, vid); err != nil {
+			break
+		}
+		var rollback *JobRollback
+		if rollback, err = users.StartJob(uid, &options); err != nil {
+			break
+		}
+		if err = jobs.Add(uid, &options); err != nil {
+			if e := users.AbortJob(uid, vid, rollback); e != nil {
+				lg.Error("admin rerun users.AbortJob", "err", e)
+			}
+		}
+
+	default:
+		w.WriteHeader(403)
+		return
+	}
+
+	if err != nil {
+		lg.Error("admin action", "err", err)
+		httpShowError(w, "操作出错:"+err.Error())
+		return
+	}
+	adminReturn(w, "操作完成")
+}
+
+func adminForm(sid string, uid uint64, vid uint64, action string, info string) string {
+	return fmt.Sprintf(`<form action="%s" method="post" style="display:inline">%s<input type="hidden" name="uid" value="%d" /><input type="hidden" name="vid" value="%d" /><input type="hidden" name="action" value="%s" /><input type="submit" value="%s" /></form>`,
+		serverConf.DomainDir+web_admin, csrfInput(sid), uid, vid, action, info)
+}
+
+//The athlete of the Strava user or the username of the local account
+func adminAccount(info *UserInfo) string {
+	if info.Username != "" {
+		return "本地账号" + html.EscapeString(info.Username)
+	}
+	return fmt.Sprintf("运动员%d", info.AthleteId)
+}
+
+//Show the videos of uid
+func adminUser(w http.ResponseWriter, r *http.Request, sid string, uid uint64) {
+	var info *UserInfo
+	for _, i := range users.List() {
+		if i.Uid == uid {
+			info = &i
+			break
+		}
+	}
+	if info == nil {
+		httpShowError(w, fmt.Sprintf("没有客户%d", uid))
+		return
+	}
+
+	if vid_str := formGetOne(r, "log"); vid_str != "" {
+		vid, err := strconv.ParseUint(vid_str, 10, 64)
+		if err != nil {
+			w.WriteHeader(403)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, filepath.Join(users.VideoDir(uid, vid), "log.txt"))
+		return
+	}
+
+	httpHead(w)
+	show := `<a href="` + serverConf.DomainDir + web_admin + `">返回</a><hr>`
+	show += fmt.Sprintf(`客户%d %s 状态:%s<br>`, uid, adminAccount(info), userStatusInfo[info.Status])
+	if info.Status == UserMakeVideoFail {
+		show += `出错类型:` + failKindInfo[info.FailKind] + `<br>出错原因:` + html.EscapeString(info.FailReason) + `<br>`
+	}
+	show += `<hr>`
+	for i := len(info.Videos) - 1; i >= 0; i-- {
+		video := info.Videos[i]
+		show += fmt.Sprintf(`%d `, video.Id) + html.EscapeString(video.Name) + ` ` + video.CreatedAt.Format(activity_layout) + ` ` + videoStatusInfo[video.Status]
+		if video.Status == VideoFail {
+			show += ` ` + failKindInfo[video.FailKind] + ` ` + html.EscapeString(video.FailReason)
+			show += fmt.Sprintf(` <a href="%s?uid=%d&log=%d">日志</a>`, serverConf.DomainDir+web_admin, uid, video.Id)
+		}
+		if video.Status == VideoFail || video.Status == VideoCancel {
+			show += ` ` + adminForm(sid, uid, video.Id, "rerun", "重新生成")
+		}
+		show += `<br>`
+	}
+	fmt.Fprintln(w, show)
+	httpTail(w)
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	sid, ok := adminCheck(w, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	if r.Method == "POST" {
+		adminAction(w, r, sid)
+		return
+	}
+
+	if uid_str := formGetOne(r, "uid"); uid_str != "" {
+		uid, err := strconv.ParseUint(uid_str, 10, 64)
+		if err != nil {
+			w.WriteHeader(403)
+			return
+		}
+		adminUser(w, r, sid, uid)
+		return
+	}
+
+	httpHead(w)
+	show := `<a href="` + serverConf.DomainDir + `">返回</a><hr>`
+	show += `<table border="1"><tr><th>客户</th><th>账号</th><th>状态</th><th>出错原因</th><th>磁盘</th><th>视频</th><th>操作</th></tr>`
+	for _, info := range users.List() {
+		size, err := dirSize(users.UserDir(info.Uid))
+		if err != nil {
+			httpLogger(r, info.Uid).Error("adminHandler dirSize", "err", err)
+		}
+		show += fmt.Sprintf(`<tr><td><a href="%s?uid=%d">%d</a></td><td>%s</td><td>%s</td>`,
+			serverConf.DomainDir+web_admin, info.Uid, info.Uid, adminAccount(&info), userStatusInfo[info.Status])
+		if info.Status == UserMakeVideoFail {
+			show += `<td>` + failKindInfo[info.FailKind] + ` ` + html.EscapeString(info.FailReason) + `</td>`
+		} else {
+			show += `<td></td>`
+		}
+		show += fmt.Sprintf(`<td>%.1fMB</td><td>%d</td><td>`, float64(size)/(1024*1024), len(info.Videos))
+		if info.Status == UserMakingVideo || info.Status == UserWaitingVideo {
+			show += adminForm(sid, info.Uid, 0, "cancel", "取消")
+			show += adminForm(sid, info.Uid, 0, "reset", "重置状态")
+		} else {
+			show += adminForm(sid, info.Uid, 0, "delete", "删除")
+		}
+		show += `</td></tr>`
+	}
+	show += `</table>`
+	fmt.Fprintln(w, show)
+	httpTail(w)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//JSON API for scripts.  Every request needs the header
+//"Authorization: Bearer <API token>".  The token can be got from
+//web_apitoken.
+//
+//  GET    activities    Strava activities and uploaded tracks that can be made to video,
+//                        see apiActivities for the filters
+//  GET    options       Options of the video
+//  GET    schema        JSON Schema of the body of "POST videos", no token needed
+//  GET    job           Status of the current job
+//  GET    videos        Videos of the user
+//  POST   videos        Make a video, the body is a JSON object of the options
+//  GET    videos/<id>   Download a video
+//  DELETE videos/<id>   Remove a video
+//  GET    photos        Photos of the user
+//  GET    photos/<id>   Download a photo
+//  DELETE photos/<id>   Remove a photo
+const web_api = "api/v1/"
+
+type ApiError struct {
+	Error string
+}
+
+type ApiActivity struct {
+	Id             int64 //Negative for the uploaded tracks
+	Name           string
+	Type           string
+	StartDateLocal time.Time
+	Distance       float64 //Meters
+	Duration       int64   //Seconds of the moving time
+	Elevation      float64 //Meters of the climb
+}
+
+const apiActivityPerPage = 100
+const apiActivityMaxPerPage = 1000
+
+type ApiOption struct {
+	Name     string
+	Info     string
+	Help     string
+	Required bool
+	Schema   *OptionSchema
+}
+
+type ApiSchema struct {
+	Schema               string                   `json:"$schema"`
+	Title                string                   `json:"title"`
+	Type                 string                   `json:"type"`
+	Properties           map[string]*OptionSchema `json:"properties"`
+	Required             []string                 `json:"required"`
+	AdditionalProperties bool                     `json:"additionalProperties"`
+}
+
+type ApiVideo struct {
+	Video
+	StatusInfo string
+}
+
+type ApiPhoto struct {
+	Id string
+}
+
+type ApiSubmit struct {
+	VideoId uint64
+}
+
+func apiInit() {
+	httpHandleFunc(serverConf.DomainDir+web_api, "api", apiHandler)
+}
+
+func apiJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("apiJSON json.Encode", "err", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, err string) {
+	apiJSON(w, code, ApiError{Error: err})
+}
+
+func apiCheckToken(r *http.Request) (uid uint64, err error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		err = errors.New("没有API令牌")
+		return
+	}
+	uid, ok := users.CheckApiToken(strings.TrimPrefix(auth, "Bearer "))
+	if !ok {
+		err = errors.New("API令牌不对")
+		return
+	}
+	users.Touch(uid)
+	return
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, serverConf.DomainDir+web_api)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 2 {
+		apiError(w, 404, "没有这个API")
+		return
+	}
+
+	if len(parts) == 1 && parts[0] == "schema" && r.Method == "GET" {
+		apiSchema(w)
+		return
+	}
+
+	uid, err := apiCheckToken(r)
+	if err != nil {
+		apiError(w, 401, err.Error())
+		return
+	}
+	id := ""
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+
+	type apiRoute struct {
+		name   string
+		hasId  bool
+		method string
+	}
+	route := apiRoute{parts[0], id != "", r.Method}
+	switch route {
+	case apiRoute{"activities", false, "GET"}:
+		apiActivities(w, r, uid)
+	case apiRoute{"options", false, "GET"}:
+		apiOptions(w)
+	case apiRoute{"job", false, "GET"}:
+		apiJob(w, uid)
+	case apiRoute{"videos", false, "GET"}:
+		apiVideos(w, uid)
+	case apiRoute{"videos", false, "POST"}:
+		apiSubmit(w, r, uid)
+	case apiRoute{"videos", true, "GET"}:
+		apiVideo(w, r, uid, id)
+	case apiRoute{"videos", true, "DELETE"}:
+		apiDelVideo(w, uid, id)
+	case apiRoute{"photos", false, "GET"}:
+		apiPhotos(w, uid)
+	case apiRoute{"photos", true, "GET"}:
+		apiPhoto(w, r, uid, id)
+	case apiRoute{"photos", true, "DELETE"}:
+		apiDelPhoto(w, uid, id)
+	default:
+		apiError(w, 404, "没有这个API")
+	}
+}
+
+//The query can have type, after and before (2006-01-02), name, page
+//(from 1) and per_page.  The number of the activities that match is in
+//the header X-Total-Count.  X-Activities-Partial is 1 if the older Strava
+//activities are not all got.
+func apiActivities(w http.ResponseWriter, r *http.Request, uid uint64) {
+	query := r.URL.Query()
+	filter := ActivityFilter{Type: query.Get("type"), Name: query.Get("name")}
+	if after := query.Get("after"); after != "" {
+		t, err := time.ParseInLocation("2006-01-02", after, time.Local)
+		if err != nil {
+			apiError(w, 400, "after格式不正确")
+			return
+		}
+		filter.After = t
+	}
+	if before := query.Get("before"); before != "" {
+		t, err := time.ParseInLocation("2006-01-02", before, time.Local)
+		if err != nil {
+			apiError(w, 400, "before格式不正确")
+			return
+		}
+		//Include the day before
+		filter.Before = t.AddDate(0, 0, 1)
+	}
+	page, per_page := 1, apiActivityPerPage
+	if s := query.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			apiError(w, 400, "page格式不正确")
+			return
+		}
+		page = n
+	}
+	if s := query.Get("per_page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > apiActivityMaxPerPage {
+			apiError(w, 400, fmt.Sprintf("per_page需要在1到%d之间", apiActivityMaxPerPage))
+			return
+		}
+		per_page = n
+	}
+
+	activities, note, err := listActivities(uid)
+	if err != nil {
+		apiError(w, 502, err.Error())
+		return
+	}
+	if note != "" {
+		w.Header().Set("X-Activities-Partial", "1")
+	}
+	activities = filterActivities(activities, &filter)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(activities)))
+
+	start := (page - 1) * per_page
+	if start > len(activities) {
+		start = len(activities)
+	}
+	end := start + per_page
+	if end > len(activities) {
+		end = len(activities)
+	}
+
+	ret := make([]ApiActivity, 0, end-start)
+	for _, activity := range activities[start:end] {
+		ret = append(ret, ApiActivity{
+			Id:             activity.Id,
+			Name:           activity.Name,
+			Type:           activity.Type,
+			StartDateLocal: activity.StartDateLocal,
+			Distance:       activity.Distance,
+			Duration:       int64(activity.Duration / time.Second),
+			Elevation:      activity.Elevation,
+		})
+	}
+	apiJSON(w, 200, ret)
+}
+
+func apiOptions(w http.ResponseWriter) {
+	ret := make([]ApiOption, 0, len(show_index))
+	for _, index := range show_index {
+		option := makevideoOptions[index]
+		if !option.Show() {
+			continue
+		}
+		ret = append(ret, ApiOption{
+			Name:     index,
+			Info:     option.GetshortInfo(),
+			Help:     option.GetlongInfo(),
+			Required: option.Getrequired(),
+			Schema:   option.GetSchema(),
+		})
+	}
+	apiJSON(w, 200, ret)
+}
+
+func apiSchema(w http.ResponseWriter) {
+	schema := ApiSchema{
+		Schema:     "http://json-schema.org/draft-07/schema#",
+		Title:      "GPS2Video",
+		Type:       "object",
+		Properties: make(map[string]*OptionSchema),
+		Required:   make([]string, 0),
+	}
+	for _, index := range show_index {
+		option := makevideoOptions[index]
+		if !option.Show() {
+			continue
+		}
+		schema.Properties[index] = option.GetSchema()
+		if option.Getrequired() {
+			schema.Required = append(schema.Required, index)
+		}
+	}
+	apiJSON(w, 200, schema)
+}
+
+func apiJob(w http.ResponseWriter, uid uint64) {
+	status, err := users.GetUserStatus(uid)
+	if err != nil {
+		apiError(w, 500, err.Error())
+		return
+	}
+	apiJSON(w, 200, getProgressStatus(uid, status))
+}
+
+func apiVideos(w http.ResponseWriter, uid uint64) {
+	videos := users.GetVideos(uid)
+	ret := make([]ApiVideo, 0, len(videos))
+	for _, video := range videos {
+		ret = append(ret, ApiVideo{Video: video, StatusInfo: videoStatusInfo[video.Status]})
+	}
+	apiJSON(w, 200, ret)
+}
+
+//Convert the JSON object of the options to the form of makevideoHandler
+func apiBody2Form(r *http.Request) (form url.Values, err error) {
+	var body map[string]interface{}
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.UseNumber()
+	if err = dec.Decode(&body); err != nil {
+		err = errors.New("提交数据出错:" + err.Error())
+		return
+	}
+
+	form = make(url.Values)
+	for index, val := range body {
+		if _, ok := makevideoOptions[index]; !ok {
+			err = fmt.Errorf("没有选项%s", index)
+			return
+		}
+		switch v := val.(type) {
+		case json.Number:
+			form.Set(index, v.String())
+		case string:
+			form.Set(index, v)
+		case bool:
+			//Same as the checkbox, unchecked is not in the form
+			if v {
+				form.Set(index, index)
+			}
+		case nil:
+		default:
+			err = fmt.Errorf("选项%s的值格式不对", index)
+			return
+		}
+	}
+	return
+}
+
+func apiSubmit(w http.ResponseWriter, r *http.Request, uid uint64) {
+	form, err := apiBody2Form(r)
+	if err != nil {
+		apiError(w, 400, err.Error())
+		return
+	}
+
+	token, err := users.GetToken(uid)
+	if err != nil && err != errNoStrava {
+		apiError(w, 500, err.Error())
+		return
+	}
+
+	vid, err := makevideoSubmit(uid, token, form)
+	if err != nil {
+		apiError(w, 400, err.Error())
+		return
+	}
+	apiJSON(w, 202, ApiSubmit{VideoId: vid})
+}
+
+func apiVideo(w http.ResponseWriter, r *http.Request, uid uint64, id string) {
+	vid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		apiError(w, 404, "没有这个视频")
+		return
+	}
+
+	video_dir := filepath.Join(users.VideoDir(uid, vid), "v.mp4")
+	exist, err := fileIsExist(video_dir)
+	if err != nil {
+		httpLogger(r, uid).Error("apiVideo fileIsExist", "file", video_dir, "err", err)
+		apiError(w, 500, err.Error())
+		return
+	}
+	if !exist {
+		apiError(w, 404, "没有这个视频")
+		return
+	}
+
+	http.ServeFile(w, r, video_dir)
+}
+
+func apiDelVideo(w http.ResponseWriter, uid uint64, id string) {
+	vid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		apiError(w, 404, "没有这个视频")
+		return
+	}
+
+	if err = users.DelVideo(uid, vid); err != nil {
+		apiError(w, 400, err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func apiPhotos(w http.ResponseWriter, uid uint64) {
+	ret := make([]ApiPhoto, 0)
+	files, err := os.ReadDir(filepath.Join(users.UserDir(uid), "photos"))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("apiPhotos os.ReadDir", "handler", "api", "uid", uid, "err", err)
+		apiError(w, 500, err.Error())
+		return
+	}
+	for _, f := range files {
+		filename := f.Name()
+		match, err := filepath.Match(`[0-9]*.jpg`, filename)
+		if err == nil && match {
+			ret = append(ret, ApiPhoto{Id: strings.TrimSuffix(filename, ".jpg")})
+		}
+	}
+	apiJSON(w, 200, ret)
+}
+
+//Get the filename of photo id, return "" if it doesn't exist
+func apiPhotoFile(uid uint64, id string) (filename string, err error) {
+	if _, err = strconv.ParseUint(id, 10, 64); err != nil {
+		err = nil
+		return
+	}
+
+	f := filepath.Join(users.UserDir(uid), "photos", id+".jpg")
+	exist, err := fileIsExist(f)
+	if err != nil || !exist {
+		return
+	}
+	filename = f
+	return
+}
+
+func apiPhoto(w http.ResponseWriter, r *http.Request, uid uint64, id string) {
+	filename, err := apiPhotoFile(uid, id)
+	if err != nil {
+		httpLogger(r, uid).Error("apiPhoto apiPhotoFile", "photo", id, "err", err)
+		apiError(w, 500, err.Error())
+		return
+	}
+	if filename == "" {
+		apiError(w, 404, "没有这个照片")
+		return
+	}
+
+	http.ServeFile(w, r, filename)
+}
+
+func apiDelPhoto(w http.ResponseWriter, uid uint64, id string) {
+	filename, err := apiPhotoFile(uid, id)
+	if err != nil {
+		slog.Error("apiDelPhoto apiPhotoFile", "handler", "api", "uid", uid, "photo", id, "err", err)
+		apiError(w, 500, err.Error())
+		return
+	}
+	if filename == "" {
+		apiError(w, 404, "没有这个照片")
+		return
+	}
+
+	if err = os.Remove(filename); err != nil {
+		slog.Error("apiDelPhoto os.Remove", "handler", "api", "uid", uid, "file", filename, "err", err)
+		apiError(w, 500, err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
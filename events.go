@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//EventHub sends the status changes of the users to the browsers that
+//listen to web_events.
+type EventHub struct {
+	lock sync.Mutex
+
+	subs map[uint64]map[chan ProgressStatus]bool
+}
+
+var events = EventHub{subs: make(map[uint64]map[chan ProgressStatus]bool)}
+
+func (h *EventHub) Subscribe(uid uint64) chan ProgressStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ch := make(chan ProgressStatus, 8)
+	if h.subs[uid] == nil {
+		h.subs[uid] = make(map[chan ProgressStatus]bool)
+	}
+	h.subs[uid][ch] = true
+	return ch
+}
+
+func (h *EventHub) Unsubscribe(uid uint64, ch chan ProgressStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.subs[uid], ch)
+	if len(h.subs[uid]) == 0 {
+		delete(h.subs, uid)
+	}
+}
+
+//Publish never blocks.  If a listener is too slow, its oldest event is dropped.
+func (h *EventHub) Publish(uid uint64, p ProgressStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for ch := range h.subs[uid] {
+		for {
+			select {
+			case ch <- p:
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+//Publish the current status of uid.
+//Must not hold users.lock or jobs.lock.
+func (h *EventHub) PublishStatus(uid uint64, status int) {
+	h.lock.Lock()
+	_, ok := h.subs[uid]
+	h.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	h.Publish(uid, getProgressStatus(uid, status))
+}
+
+func writeEvent(w http.ResponseWriter, p ProgressStatus) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+	return err
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := checkCookie(r)
+	if err != nil {
+		w.WriteHeader(403)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+
+	ch := events.Subscribe(uid)
+	defer events.Unsubscribe(uid, ch)
+
+	status, err := users.GetUserStatus(uid)
+	if err != nil {
+		httpLogger(r, uid).Error("eventsHandler users.GetUserStatus", "err", err)
+		w.WriteHeader(403)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	if err = writeEvent(w, getProgressStatus(uid, status)); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case p := <-ch:
+			if err = writeEvent(w, p); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err = fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+//The kinds of the failures of makeVideo
+const (
+	FailUnknown       = "unknown"
+	FailSystem        = "system"
+	FailStrava        = "strava"
+	FailPhoto         = "photo"
+	FailMapApi        = "mapapi"
+	FailFfmpegMissing = "ffmpeg_missing"
+	FailFfmpeg        = "ffmpeg"
+	FailTimeout       = "timeout"
+	FailKilled        = "killed"
+	FailQuota         = "quota"
+	FailInterrupted   = "interrupted"
+)
+
+var failKindInfo = map[string]string{
+	FailUnknown:       "GPS2Video程序执行出错",
+	FailSystem:        "系统出错",
+	FailStrava:        "Strava接口出错",
+	FailPhoto:         "下载照片出错",
+	FailMapApi:        "地图接口的配额用完或者密钥出错",
+	FailFfmpegMissing: "找不到ffmpeg",
+	FailFfmpeg:        "ffmpeg执行出错",
+	FailTimeout:       "生成视频超时",
+	FailKilled:        "生成视频的程序被杀掉了",
+	FailQuota:         "磁盘空间超过了配额",
+	FailInterrupted:   "服务器重启，视频生成被中断，已经重新排队",
+}
+
+//Why makeVideo failed
+type FailInfo struct {
+	Kind   string
+	Reason string //Shown to the user
+	Tail   string //The last lines of the output of the renderer
+}
+
+//How many lines of the output are kept in FailInfo.Tail
+const failTailLines = 20
+
+//The output of gps2video is matched with these patterns to get the kind.
+//The first matched pattern wins.
+var failKindPatterns = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{FailMapApi, regexp.MustCompile(`(?i)OVER_QUERY_LIMIT|OVER_DAILY_LIMIT|REQUEST_DENIED|API key|quota|googleapis.*\b40[0-3]\b`)},
+	{FailFfmpegMissing, regexp.MustCompile(`(?i)ffmpeg.*(not found|No such file)|No such file.*ffmpeg`)},
+	{FailFfmpeg, regexp.MustCompile(`(?i)ffmpeg.*(error|fail|non-zero)|Conversion failed`)},
+}
+
+func failKindFromOutput(lines []string) string {
+	for _, p := range failKindPatterns {
+		for _, line := range lines {
+			if p.re.MatchString(line) {
+				return p.kind
+			}
+		}
+	}
+	return ""
+}
+
+//Get the kind of the failure of a subprocess from the error of
+//exec.Cmd.Wait, the context of it and the error lines of its output.
+func failKindFromRun(ctx context.Context, err error, errLines []string) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return FailTimeout
+	}
+	if ctx.Err() != nil {
+		return FailKilled
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return FailKilled
+		}
+	}
+	if kind := failKindFromOutput(errLines); kind != "" {
+		return kind
+	}
+	return FailUnknown
+}
+
+//Keep the last n lines
+type tailLines struct {
+	n     int
+	lines []string
+}
+
+func (t *tailLines) Add(line string) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.n {
+		t.lines = t.lines[len(t.lines)-t.n:]
+	}
+}
+
+func (t *tailLines) String() string {
+	return strings.Join(t.lines, "\n")
+}
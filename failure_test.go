@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestFailKindFromOutput(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"empty", nil, ""},
+		{"nothing", []string{"Traceback", "KeyError: 'x'"}, ""},
+		{"map quota", []string{"status: OVER_QUERY_LIMIT"}, FailMapApi},
+		{"map key", []string{"The provided api key is invalid"}, FailMapApi},
+		{"map http", []string{"GET https://maps.googleapis.com/maps/api/staticmap 403"}, FailMapApi},
+		{"ffmpeg missing", []string{"sh: ffmpeg: not found"}, FailFfmpegMissing},
+		{"ffmpeg missing file", []string{"[Errno 2] No such file or directory: 'ffmpeg'"}, FailFfmpegMissing},
+		{"ffmpeg", []string{"Conversion failed!"}, FailFfmpeg},
+		{"ffmpeg exit", []string{"ffmpeg returned non-zero exit status 1"}, FailFfmpeg},
+		//The first pattern wins even if it matches a later line
+		{"order of patterns", []string{"ffmpeg error", "REQUEST_DENIED"}, FailMapApi},
+		{"missing wins ffmpeg", []string{"ffmpeg error: No such file"}, FailFfmpegMissing},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := failKindFromOutput(test.lines); got != test.want {
+				t.Errorf("failKindFromOutput(%q) = %q, want %q", test.lines, got, test.want)
+			}
+		})
+	}
+}
+
+//Run the shell script and return the error of it
+func failRunScript(t *testing.T, script string) error {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	return exec.Command("sh", "-c", script).Run()
+}
+
+func TestFailKindFromRun(t *testing.T) {
+	timeout, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-timeout.Done()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	exit_err := failRunScript(t, "exit 1")
+	signal_err := failRunScript(t, "kill -9 $$")
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		err   error
+		lines []string
+		want  string
+	}{
+		{"timeout", timeout, exit_err, []string{"Conversion failed"}, FailTimeout},
+		{"cancelled", cancelled, exit_err, []string{"Conversion failed"}, FailKilled},
+		{"signal", context.Background(), signal_err, []string{"Conversion failed"}, FailKilled},
+		{"output", context.Background(), exit_err, []string{"OVER_DAILY_LIMIT"}, FailMapApi},
+		{"unknown", context.Background(), exit_err, []string{"KeyError"}, FailUnknown},
+		{"not exit error", context.Background(), errors.New("start"), nil, FailUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := failKindFromRun(test.ctx, test.err, test.lines); got != test.want {
+				t.Errorf("failKindFromRun(%v, %q) = %q, want %q", test.err, test.lines, got, test.want)
+			}
+		})
+	}
+}
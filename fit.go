@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+//A small decoder of the FIT files of Garmin and the other devices.  It
+//only gets the position, altitude and time of the record messages.
+
+const (
+	fitMesgRecord = 20
+
+	fitFieldTimestamp        = 253
+	fitFieldPositionLat      = 0
+	fitFieldPositionLong     = 1
+	fitFieldAltitude         = 2
+	fitFieldEnhancedAltitude = 78
+)
+
+//The time of the FIT files is the seconds since 1989-12-31 00:00:00 UTC
+var fitEpoch = time.Date(1989, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+type fitField struct {
+	num  byte
+	size int
+}
+
+type fitDefinition struct {
+	order  binary.ByteOrder
+	global uint16
+	fields []fitField
+	size   int //Size of the data message
+}
+
+type fitPoint struct {
+	Time      time.Time
+	Latitude  float64
+	Longitude float64
+	Elevation float64
+	HasEle    bool
+}
+
+//Return the unsigned integer in b, ok is false if it is the invalid value
+func fitUint(order binary.ByteOrder, b []byte) (v uint64, ok bool) {
+	switch len(b) {
+	case 1:
+		v = uint64(b[0])
+		ok = v != math.MaxUint8
+	case 2:
+		v = uint64(order.Uint16(b))
+		ok = v != math.MaxUint16
+	case 4:
+		v = uint64(order.Uint32(b))
+		ok = v != math.MaxUint32
+	}
+	return
+}
+
+func fitSemicircles(order binary.ByteOrder, b []byte) (deg float64, ok bool) {
+	if len(b) != 4 {
+		return
+	}
+	v := int32(order.Uint32(b))
+	if v == math.MaxInt32 {
+		return
+	}
+	deg = float64(v) * 180 / (1 << 31)
+	ok = true
+	return
+}
+
+var fitCRCTable = [16]uint16{
+	0x0000, 0xcc01, 0xd801, 0x1400, 0xf001, 0x3c00, 0x2800, 0xe401,
+	0xa001, 0x6c00, 0x7800, 0xb401, 0x5000, 0x9c01, 0x8801, 0x4400,
+}
+
+//CRC-16 of the FIT files
+func fitCRC(data []byte) (crc uint16) {
+	for _, b := range data {
+		tmp := fitCRCTable[crc&0xf]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ fitCRCTable[b&0xf]
+		tmp = fitCRCTable[crc&0xf]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ fitCRCTable[(b>>4)&0xf]
+	}
+	return
+}
+
+func parseFIT(data []byte) (points []fitPoint, err error) {
+	if len(data) < 12 {
+		err = errors.New("文件太短")
+		return
+	}
+	header_size := int(data[0])
+	if header_size < 12 || len(data) < header_size || string(data[8:12]) != ".FIT" {
+		err = errors.New("不是FIT文件")
+		return
+	}
+	//The CRC of the header is optional, 0 means not set
+	if header_size >= 14 {
+		if crc := binary.LittleEndian.Uint16(data[12:14]); crc != 0 && crc != fitCRC(data[:12]) {
+			err = errors.New("文件头的CRC不正确")
+			return
+		}
+	}
+	end := header_size + int(binary.LittleEndian.Uint32(data[4:8]))
+	//The CRC of the file is after the data
+	if end+2 > len(data) {
+		err = errors.New("文件不完整")
+		return
+	}
+	if binary.LittleEndian.Uint16(data[end:end+2]) != fitCRC(data[:end]) {
+		err = errors.New("文件的CRC不正确")
+		return
+	}
+
+	var definitions [16]*fitDefinition
+	var last_timestamp uint32
+	for pos := header_size; pos < end; {
+		header := data[pos]
+		pos++
+
+		local := header & 0x0f
+		compressed := header&0x80 != 0
+		if compressed {
+			local = (header >> 5) & 0x03
+			offset := uint32(header & 0x1f)
+			timestamp := last_timestamp&^0x1f + offset
+			if offset < last_timestamp&0x1f {
+				timestamp += 0x20
+			}
+			last_timestamp = timestamp
+		} else if header&0x40 != 0 {
+			//Definition message
+			if pos+5 > end {
+				err = errors.New("文件不完整")
+				return
+			}
+			def := &fitDefinition{order: binary.LittleEndian}
+			if data[pos+1] == 1 {
+				def.order = binary.BigEndian
+			}
+			def.global = def.order.Uint16(data[pos+2 : pos+4])
+			num := int(data[pos+4])
+			pos += 5
+			if pos+num*3 > end {
+				err = errors.New("文件不完整")
+				return
+			}
+			for i := 0; i < num; i++ {
+				field := fitField{num: data[pos], size: int(data[pos+1])}
+				def.fields = append(def.fields, field)
+				def.size += field.size
+				pos += 3
+			}
+			if header&0x20 != 0 {
+				//Developer fields are skipped
+				if pos >= end {
+					err = errors.New("文件不完整")
+					return
+				}
+				num = int(data[pos])
+				pos++
+				if pos+num*3 > end {
+					err = errors.New("文件不完整")
+					return
+				}
+				for i := 0; i < num; i++ {
+					def.fields = append(def.fields, fitField{num: 0xff, size: int(data[pos+1])})
+					def.size += int(data[pos+1])
+					pos += 3
+				}
+			}
+			definitions[local] = def
+			continue
+		}
+
+		//Data message
+		def := definitions[local]
+		if def == nil {
+			err = fmt.Errorf("没有本地消息%d的定义", local)
+			return
+		}
+		if pos+def.size > end {
+			err = errors.New("文件不完整")
+			return
+		}
+		point := fitPoint{}
+		has_lat, has_long := false, false
+		for _, field := range def.fields {
+			b := data[pos : pos+field.size]
+			pos += field.size
+			if field.num == 0xff {
+				continue
+			}
+			if field.num == fitFieldTimestamp {
+				if v, ok := fitUint(def.order, b); ok {
+					last_timestamp = uint32(v)
+				}
+				continue
+			}
+			if def.global != fitMesgRecord {
+				continue
+			}
+			switch field.num {
+			case fitFieldPositionLat:
+				point.Latitude, has_lat = fitSemicircles(def.order, b)
+			case fitFieldPositionLong:
+				point.Longitude, has_long = fitSemicircles(def.order, b)
+			case fitFieldAltitude, fitFieldEnhancedAltitude:
+				if v, ok := fitUint(def.order, b); ok && (field.num == fitFieldEnhancedAltitude || !point.HasEle) {
+					point.Elevation = float64(v)/5 - 500
+					point.HasEle = true
+				}
+			}
+		}
+		if def.global != fitMesgRecord || !has_lat || !has_long || last_timestamp == 0 {
+			continue
+		}
+		point.Time = fitEpoch.Add(time.Duration(last_timestamp) * time.Second)
+		points = append(points, point)
+	}
+
+	return
+}
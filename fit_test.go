@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+//Build the FIT files for the tests
+type fitBuilder struct {
+	data []byte
+}
+
+type fitTestField struct {
+	num  byte
+	size byte
+}
+
+var fitTestRecordFields = []fitTestField{
+	{fitFieldTimestamp, 4}, {fitFieldPositionLat, 4}, {fitFieldPositionLong, 4}, {fitFieldAltitude, 2},
+}
+
+func (b *fitBuilder) define(local byte, global uint16, big bool, fields []fitTestField, dev []fitTestField) *fitBuilder {
+	header := 0x40 | local
+	if dev != nil {
+		header |= 0x20
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	arch := byte(0)
+	if big {
+		order = binary.BigEndian
+		arch = 1
+	}
+	b.data = append(b.data, header, 0, arch)
+	b.data = append(b.data, fitTestU16(order, global)...)
+	b.data = append(b.data, byte(len(fields)))
+	for _, f := range fields {
+		b.data = append(b.data, f.num, f.size, 0)
+	}
+	if dev != nil {
+		b.data = append(b.data, byte(len(dev)))
+		for _, f := range dev {
+			b.data = append(b.data, f.num, f.size, 0)
+		}
+	}
+	return b
+}
+
+//Append a data message, header is the record header
+func (b *fitBuilder) message(header byte, values ...[]byte) *fitBuilder {
+	b.data = append(b.data, header)
+	for _, v := range values {
+		b.data = append(b.data, v...)
+	}
+	return b
+}
+
+//The file with a header of header_size bytes and the right CRCs
+func (b *fitBuilder) file(header_size int) []byte {
+	header := make([]byte, header_size)
+	header[0] = byte(header_size)
+	header[1] = 0x20
+	binary.LittleEndian.PutUint16(header[2:4], 2140)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(b.data)))
+	copy(header[8:12], ".FIT")
+	if header_size >= 14 {
+		binary.LittleEndian.PutUint16(header[12:14], fitCRC(header[:12]))
+	}
+	data := append(header, b.data...)
+	return append(data, fitTestU16(binary.LittleEndian, fitCRC(data))...)
+}
+
+func fitTestU16(order binary.ByteOrder, v uint16) []byte {
+	b := make([]byte, 2)
+	order.PutUint16(b, v)
+	return b
+}
+
+func fitTestU32(order binary.ByteOrder, v uint32) []byte {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return b
+}
+
+func fitTestDeg(order binary.ByteOrder, deg float64) []byte {
+	return fitTestU32(order, uint32(int32(deg*(1<<31)/180)))
+}
+
+func fitTestEle(order binary.ByteOrder, ele float64) []byte {
+	return fitTestU16(order, uint16((ele+500)*5))
+}
+
+//A record message of fitTestRecordFields
+func fitTestRecord(order binary.ByteOrder, timestamp uint32, lat float64, long float64, ele float64) [][]byte {
+	return [][]byte{fitTestU32(order, timestamp), fitTestDeg(order, lat), fitTestDeg(order, long), fitTestEle(order, ele)}
+}
+
+var le = binary.LittleEndian
+
+//A file with two points
+func fitTestFile() *fitBuilder {
+	b := new(fitBuilder)
+	b.define(0, fitMesgRecord, false, fitTestRecordFields, nil)
+	b.message(0, fitTestRecord(le, 1000000000, 31.5, 121.25, 10)...)
+	b.message(0, fitTestRecord(le, 1000000001, 31.6, 121.35, 12.4)...)
+	return b
+}
+
+func fitTime(timestamp uint32) time.Time {
+	return fitEpoch.Add(time.Duration(timestamp) * time.Second)
+}
+
+func TestParseFIT(t *testing.T) {
+	two_points := []fitPoint{
+		{Time: fitTime(1000000000), Latitude: 31.5, Longitude: 121.25, Elevation: 10, HasEle: true},
+		{Time: fitTime(1000000001), Latitude: 31.6, Longitude: 121.35, Elevation: 12.4, HasEle: true},
+	}
+
+	tests := []struct {
+		name string
+		data func() []byte
+		want []fitPoint
+		err  bool
+	}{
+		{"12 bytes header", func() []byte { return fitTestFile().file(12) }, two_points, false},
+		{"14 bytes header", func() []byte { return fitTestFile().file(14) }, two_points, false},
+		{"no header CRC", func() []byte {
+			data := fitTestFile().file(14)
+			data[12], data[13] = 0, 0
+			end := len(data) - 2
+			return append(data[:end], fitTestU16(binary.LittleEndian, fitCRC(data[:end]))...)
+		}, two_points, false},
+		{"wrong header CRC", func() []byte {
+			data := fitTestFile().file(14)
+			data[12] ^= 0xff
+			return data
+		}, nil, true},
+		{"wrong CRC", func() []byte {
+			data := fitTestFile().file(14)
+			data[len(data)-1] ^= 0xff
+			return data
+		}, nil, true},
+		{"changed data", func() []byte {
+			data := fitTestFile().file(14)
+			data[20] ^= 0x01
+			return data
+		}, nil, true},
+		{"no CRC", func() []byte {
+			data := fitTestFile().file(14)
+			return data[:len(data)-2]
+		}, nil, true},
+		{"short", func() []byte { return []byte("0123456789") }, nil, true},
+		{"not FIT", func() []byte {
+			data := fitTestFile().file(12)
+			copy(data[8:12], ".FIX")
+			return data
+		}, nil, true},
+		{"data size bigger than file", func() []byte {
+			data := fitTestFile().file(12)
+			binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)))
+			return data
+		}, nil, true},
+
+		{"compressed timestamp", func() []byte {
+			b := new(fitBuilder)
+			b.define(0, fitMesgRecord, false, fitTestRecordFields, nil)
+			b.define(1, fitMesgRecord, false, fitTestRecordFields[1:], nil)
+			//1000000010 & 0x1f is 10
+			b.message(0, fitTestRecord(le, 1000000010, 1, 2, 3)...)
+			b.message(0x80|1<<5|15, fitTestDeg(le, 4), fitTestDeg(le, 5), fitTestEle(le, 6))
+			//The offset is less than the last one, so it rolls over
+			b.message(0x80|1<<5|5, fitTestDeg(le, 7), fitTestDeg(le, 8), fitTestEle(le, 9))
+			return b.file(14)
+		}, []fitPoint{
+			{Time: fitTime(1000000010), Latitude: 1, Longitude: 2, Elevation: 3, HasEle: true},
+			{Time: fitTime(1000000015), Latitude: 4, Longitude: 5, Elevation: 6, HasEle: true},
+			{Time: fitTime(1000000037), Latitude: 7, Longitude: 8, Elevation: 9, HasEle: true},
+		}, false},
+
+		{"redefined local message", func() []byte {
+			b := new(fitBuilder)
+			b.define(0, fitMesgRecord, false, fitTestRecordFields, nil)
+			b.message(0, fitTestRecord(le, 1000000000, 1, 2, 3)...)
+			//Event message, its data is not a point
+			b.define(0, 21, false, []fitTestField{{fitFieldTimestamp, 4}, {0, 1}, {1, 1}}, nil)
+			b.message(0, fitTestU32(le, 1000000005), []byte{0}, []byte{4})
+			//Record again with big endian and the fields in another order
+			be := binary.BigEndian
+			b.define(0, fitMesgRecord, true, []fitTestField{
+				{fitFieldPositionLong, 4}, {fitFieldAltitude, 2}, {fitFieldTimestamp, 4}, {fitFieldPositionLat, 4},
+			}, nil)
+			b.message(0, fitTestDeg(be, 20), fitTestEle(be, 30), fitTestU32(be, 1000000006), fitTestDeg(be, 10))
+			return b.file(14)
+		}, []fitPoint{
+			{Time: fitTime(1000000000), Latitude: 1, Longitude: 2, Elevation: 3, HasEle: true},
+			{Time: fitTime(1000000006), Latitude: 10, Longitude: 20, Elevation: 30, HasEle: true},
+		}, false},
+
+		{"developer fields", func() []byte {
+			b := new(fitBuilder)
+			b.define(2, fitMesgRecord, false, fitTestRecordFields, []fitTestField{{0, 3}, {1, 1}})
+			values := fitTestRecord(le, 1000000000, 1, 2, 3)
+			values = append(values, []byte{0xff, 0xff, 0xff}, []byte{0xff})
+			b.message(2, values...)
+			return b.file(14)
+		}, []fitPoint{
+			{Time: fitTime(1000000000), Latitude: 1, Longitude: 2, Elevation: 3, HasEle: true},
+		}, false},
+
+		{"enhanced altitude", func() []byte {
+			b := new(fitBuilder)
+			fields := append([]fitTestField{{fitFieldEnhancedAltitude, 4}}, fitTestRecordFields...)
+			b.define(0, fitMesgRecord, false, fields, nil)
+			values := append([][]byte{fitTestU32(le, uint32((100+500)*5))}, fitTestRecord(le, 1000000000, 1, 2, 3)...)
+			b.message(0, values...)
+			return b.file(14)
+		}, []fitPoint{
+			{Time: fitTime(1000000000), Latitude: 1, Longitude: 2, Elevation: 100, HasEle: true},
+		}, false},
+
+		{"invalid values", func() []byte {
+			b := new(fitBuilder)
+			b.define(0, fitMesgRecord, false, fitTestRecordFields, nil)
+			//No position
+			b.message(0, fitTestU32(le, 1000000000), fitTestU32(le, math.MaxInt32), fitTestU32(le, math.MaxInt32), fitTestEle(le, 3))
+			//No altitude
+			b.message(0, fitTestU32(le, 1000000001), fitTestDeg(le, 1), fitTestDeg(le, 2), []byte{0xff, 0xff})
+			return b.file(14)
+		}, []fitPoint{
+			{Time: fitTime(1000000001), Latitude: 1, Longitude: 2},
+		}, false},
+
+		{"no timestamp yet", func() []byte {
+			b := new(fitBuilder)
+			b.define(0, fitMesgRecord, false, fitTestRecordFields[1:], nil)
+			b.message(0, fitTestDeg(le, 1), fitTestDeg(le, 2), fitTestEle(le, 3))
+			return b.file(14)
+		}, nil, false},
+
+		{"no definition", func() []byte {
+			b := fitTestFile()
+			b.message(3, fitTestRecord(le, 1000000002, 1, 2, 3)...)
+			return b.file(14)
+		}, nil, true},
+		{"compressed without definition", func() []byte {
+			b := fitTestFile()
+			b.message(0x80|2<<5|1, fitTestDeg(le, 1))
+			return b.file(14)
+		}, nil, true},
+		{"truncated definition", func() []byte {
+			b := fitTestFile()
+			b.data = append(b.data, 0x40, 0, 0, fitMesgRecord, 0, 5, fitFieldTimestamp, 4)
+			return b.file(14)
+		}, nil, true},
+		{"truncated definition header", func() []byte {
+			b := fitTestFile()
+			b.data = append(b.data, 0x40, 0, 0)
+			return b.file(14)
+		}, nil, true},
+		{"truncated developer fields", func() []byte {
+			b := fitTestFile()
+			b.data = append(b.data, 0x60, 0, 0, fitMesgRecord, 0, 1, fitFieldTimestamp, 4, 0, 2, 0)
+			return b.file(14)
+		}, nil, true},
+		{"oversized field", func() []byte {
+			b := new(fitBuilder)
+			b.define(0, fitMesgRecord, false, []fitTestField{{fitFieldTimestamp, 255}, {fitFieldPositionLat, 255}}, nil)
+			b.message(0, fitTestRecord(le, 1000000000, 1, 2, 3)...)
+			return b.file(14)
+		}, nil, true},
+		{"truncated message", func() []byte {
+			b := fitTestFile()
+			b.message(0, fitTestU32(le, 1000000002))
+			return b.file(14)
+		}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			points, err := parseFIT(test.data())
+			if test.err {
+				if err == nil {
+					t.Errorf("parseFIT = %v, want an error", points)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != len(test.want) {
+				t.Fatalf("parseFIT = %v, want %v", points, test.want)
+			}
+			for i := range points {
+				got, want := points[i], test.want[i]
+				if !got.Time.Equal(want.Time) || got.HasEle != want.HasEle ||
+					math.Abs(got.Latitude-want.Latitude) > 1e-6 || math.Abs(got.Longitude-want.Longitude) > 1e-6 ||
+					math.Abs(got.Elevation-want.Elevation) > 0.2 {
+					t.Errorf("point %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+//The file cut at any byte must return an error or the points before it,
+//never panic
+func TestParseFITTruncated(t *testing.T) {
+	b := new(fitBuilder)
+	b.define(0, fitMesgRecord, false, fitTestRecordFields, []fitTestField{{0, 2}})
+	b.message(0, append(fitTestRecord(le, 1000000000, 1, 2, 3), []byte{0, 0})...)
+	b.define(1, fitMesgRecord, true, fitTestRecordFields[1:], nil)
+	be := binary.BigEndian
+	b.message(0x80|1<<5|3, fitTestDeg(be, 4), fitTestDeg(be, 5), fitTestEle(be, 6))
+	data := b.data
+
+	for n := 0; n < len(data); n++ {
+		b.data = data[:n]
+		if points, err := parseFIT(b.file(14)); err == nil && len(points) > 2 {
+			t.Errorf("cut at %d: got %d points", n, len(points))
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/koding/multiconfig"
 	"github.com/teawater/go.strava"
@@ -28,6 +35,42 @@ type Server struct {
 	SmtpPort       int    `default:"25"`
 	SmtpEmail      string `default:""`
 	SmtpPassword   string `default:""`
+	VideoWorkers   int    `default:"1"`         //Number of videos that can be made at the same time
+	MaxVideos      int    `default:"5"`         //Number of videos kept for each user, 0 means no limit
+	Renderer       string `default:"gps2video"` //gps2video or fake
+	UserStore      string `default:"bolt"`      //bolt (WorkDir/users.db) or gob (WorkDir/<uid>/user.gob)
+
+	ActivityCacheSecs int `default:"600"` //Seconds that the Strava activities of a user are cached
+
+	//Limits of making a video, 0 means no limit
+	MakeVideoTimeout int `default:"7200"` //Wall-clock seconds of a job
+	MakeVideoCpuSecs int `default:"0"`    //CPU seconds of each process, Linux only
+	MakeVideoMemMB   int `default:"0"`    //Address space of each process, Linux only
+	MakeVideoNice    int `default:"0"`    //Niceness of gps2video, Linux only
+
+	ShutdownGrace int `default:"60"` //Seconds to wait for the running jobs when shutdown
+
+	LocalAccounts bool `default:"False"` //Users can register with username and password, needs SmtpServer to verify the email
+
+	SessionSecret string `default:""`      //Key to sign the session cookies, empty means a random key in WorkDir
+	SessionMaxAge int    `default:"86400"` //Seconds
+
+	//The admin pages can be accessed by these athletes or with the password
+	AdminAthletes string `default:""` //Athlete IDs separated by ","
+	AdminPassword string `default:""` //Password of HTTP basic authentication
+
+	//Log
+	LogLevel     string `default:"info"` //debug, info, warn or error
+	LogFormat    string `default:"text"` //text (logfmt) or json
+	LogMaxSizeMB int    `default:"100"`  //Rotate the log file when it is bigger than it, 0 means no rotation
+	LogMaxFiles  int    `default:"5"`    //Number of the rotated log files that are kept
+
+	//Disk usage, 0 means no limit
+	UserQuotaMB      int `default:"0"`    //Size of WorkDir/<uid>
+	VideoMaxAgeDays  int `default:"0"`    //Remove the videos that are older than it
+	OutputMaxAgeDays int `default:"1"`    //Remove the files in WorkDir/<uid>/output that are older than it
+	UserMaxIdleDays  int `default:"0"`    //Remove the users that are inactive longer than it
+	JanitorInterval  int `default:"3600"` //Seconds between the cleanups, 0 means no cleanup
 }
 
 var serverConf *Server
@@ -40,19 +83,16 @@ func main() {
 		log.Fatalf("Usage: %s config [log]", os.Args[0])
 	}
 
-	if args_len == 3 {
-		logFile, err := os.Create(os.Args[2])
-		if err != nil {
-			log.Fatalln("os.Create", os.Args[2], err)
-		}
-		defer logFile.Close()
-		log.SetOutput(logFile)
-	}
-
 	//Setup serverConf
 	m := multiconfig.NewWithPath(os.Args[1])
 	serverConf = new(Server)
 	m.MustLoad(serverConf)
+
+	log_file := ""
+	if args_len == 3 {
+		log_file = os.Args[2]
+	}
+	logInit(log_file)
 	if serverConf.Port == 0 {
 		if serverConf.SSL {
 			serverConf.Port = 443
@@ -62,19 +102,37 @@ func main() {
 	}
 	if serverConf.SSL {
 		if serverConf.SSLcertFile == "" || serverConf.SSLkeyFile == "" {
-			log.Fatalln("If 'SSL' is true, field 'SSLcertFile' and 'SSLkeyFile' is required")
+			fatal("If 'SSL' is true, field 'SSLcertFile' and 'SSLkeyFile' is required")
 		}
 	}
 
+	rendererInit()
+
+	jobs.Init(serverConf.WorkDir)
 	users.Init(serverConf.WorkDir)
+	sessions.Init(serverConf.WorkDir)
+	jobs.Start(serverConf.VideoWorkers)
+	janitorStart()
 
 	httpInit()
 
-	if serverConf.SSL {
-		log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", serverConf.Port), serverConf.SSLcertFile, serverConf.SSLkeyFile, nil))
-	} else {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", serverConf.Port), nil))
-	}
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", serverConf.Port)}
+	go func() {
+		var err error
+		if serverConf.SSL {
+			err = srv.ListenAndServeTLS(serverConf.SSLcertFile, serverConf.SSLkeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("srv.ListenAndServe", "err", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	<-ctx.Done()
+	stop()
+	shutdown(srv)
 }
 
 func dir_check_creat(dir string, remove_wrong bool) (err error) {
@@ -113,3 +171,70 @@ func fileIsExist(dir string) (exist bool, err error) {
 	exist = true
 	return
 }
+
+//Return a random string that has n random bytes in hex
+func randomHex(n int) (str string, err error) {
+	buf := make([]byte, n)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+	str = hex.EncodeToString(buf)
+	return
+}
+
+//Write file with a temp file, fsync and rename.  Then the old file is
+//still right if the program crashes or the disk is full.
+func writeFileAtomic(file string, write func(w io.Writer) error) (err error) {
+	dir := filepath.Dir(file)
+	fd, err := os.CreateTemp(dir, "."+filepath.Base(file)+".tmp*")
+	if err != nil {
+		return
+	}
+	tmp := fd.Name()
+	defer func() {
+		if err != nil {
+			fd.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if err = fd.Chmod(0600); err != nil {
+		return
+	}
+	if err = write(fd); err != nil {
+		return
+	}
+	if err = fd.Sync(); err != nil {
+		return
+	}
+	if err = fd.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return
+	}
+
+	//Make sure the rename is on the disk
+	if dir_fd, e := os.Open(dir); e == nil {
+		dir_fd.Sync()
+		dir_fd.Close()
+	}
+	return
+}
+
+//The size of all the files in dir
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if f.Mode().IsRegular() {
+			size += f.Size()
+		}
+		return nil
+	})
+	return
+}
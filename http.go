@@ -1,10 +1,11 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,9 +16,14 @@ import (
 )
 
 const web_logout = "logout"
+const web_login = "login"
 const web_activity = "activity"
 const web_photos = "photos"
 const web_makevideo = "makevideo"
+const web_cancel = "cancel"
+const web_progress = "progress"
+const web_events = "events"
+const web_apitoken = "apitoken"
 const web_video = "v.mp4"
 const activity_layout = "2006-01-02 15:04:05"
 const stravaphotos_layout = "2006:01:02 15:04:05"
@@ -37,7 +43,7 @@ func httpInit() {
 		serverConf.Port)
 	callbackURL := baseURL + "/exchange_token"
 	baseURL += serverConf.DomainDir
-	log.Println(baseURL)
+	slog.Info("httpInit", "url", baseURL)
 
 	strava.ClientId = serverConf.ClientId
 	strava.ClientSecret = serverConf.ClientSecret
@@ -50,14 +56,24 @@ func httpInit() {
 
 	path, err := authenticator.CallbackPath()
 	if err != nil {
-		log.Fatal(err)
-	}
-	http.HandleFunc(path, authenticator.HandlerFunc(oAuthSuccess, oAuthFailure))
-	http.HandleFunc(serverConf.DomainDir, indexHandler)
-	http.HandleFunc(serverConf.DomainDir+web_logout, logoutHandler)
-	http.HandleFunc(serverConf.DomainDir+web_photos, photosHandler)
-	http.HandleFunc(serverConf.DomainDir+web_makevideo, makevideoHandler)
-	http.HandleFunc(serverConf.DomainDir+web_video, videoHandler)
+		fatal("authenticator.CallbackPath", "err", err)
+	}
+	httpHandleFunc(path, "oauth", stravaOAuthHandler)
+	httpHandleFunc(serverConf.DomainDir, "index", indexHandler)
+	httpHandleFunc(serverConf.DomainDir+web_logout, "logout", logoutHandler)
+	httpHandleFunc(serverConf.DomainDir+web_login, "login", loginHandler)
+	httpHandleFunc(serverConf.DomainDir+web_photos, "photos", photosHandler)
+	httpHandleFunc(serverConf.DomainDir+web_tracks, "tracks", tracksHandler)
+	httpHandleFunc(serverConf.DomainDir+web_makevideo, "makevideo", makevideoHandler)
+	httpHandleFunc(serverConf.DomainDir+web_video, "video", videoHandler)
+	httpHandleFunc(serverConf.DomainDir+web_cancel, "cancel", cancelHandler)
+	httpHandleFunc(serverConf.DomainDir+web_progress, "progress", progressHandler)
+	httpHandleFunc(serverConf.DomainDir+web_events, "events", eventsHandler)
+	httpHandleFunc(serverConf.DomainDir+web_apitoken, "apitoken", apitokenHandler)
+	accountInit()
+	apiInit()
+	adminInit()
+	metricsInit()
 }
 
 func formGetOne(r *http.Request, id string) string {
@@ -69,45 +85,54 @@ func formGetOne(r *http.Request, id string) string {
 	return vals[0]
 }
 
-func checkCookie(r *http.Request) (uid uint64, token string, err error) {
-	var cookie *http.Cookie
-
-	if cookie, err = r.Cookie("uid"); err != nil {
-		return
-	}
-	if uid, err = strconv.ParseUint(cookie.Value, 10, 64); err != nil {
+//Get uid and the session ID from the session cookie
+func checkCookie(r *http.Request) (uid uint64, sid string, err error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
 		return
 	}
 
-	if cookie, err = r.Cookie("token"); err != nil {
+	if sid, uid, err = sessions.Get(cookie.Value); err != nil {
 		return
 	}
-	token = cookie.Value
+	users.Touch(uid)
+	return
+}
 
-	if !users.Check(uid, token) {
-		err = errors.New(fmt.Sprintf("uid %d token %s is not right",
-			uid, token))
+func addCookie(w http.ResponseWriter, stoken *StravaToken) (err error) {
+	uid, err := users.FindAdd(stoken)
+	if err != nil {
 		return
 	}
 
+	err = loginSession(w, uid)
 	return
 }
 
-func addCookie(w http.ResponseWriter, token string) (err error) {
-	uid, err := users.FindAdd(token)
+//Create a session of uid and set the cookie
+func loginSession(w http.ResponseWriter, uid uint64) (err error) {
+	value, err := sessions.New(uid)
 	if err != nil {
 		return
 	}
+	http.SetCookie(w, newSessionCookie(value, serverConf.SessionMaxAge))
+	return
+}
 
-	cookie := http.Cookie{Name: "uid", Value: fmt.Sprintf("%d", uid), Path: serverConf.DomainDir, MaxAge: 86400}
-	http.SetCookie(w, &cookie)
-	cookie = http.Cookie{Name: "token", Value: token, Path: serverConf.DomainDir, MaxAge: 86400}
-	http.SetCookie(w, &cookie)
+//The hidden input that must be in each form that uses POST
+func csrfInput(sid string) string {
+	return `<input type="hidden" name="` + csrfField + `" value="` + sessions.CSRFToken(sid) + `" />`
+}
 
-	return
+func httpCSRFError(w http.ResponseWriter) {
+	w.WriteHeader(403)
+	httpShowError(w, "请求没有通过安全检查，请刷新页面后重试")
 }
 
 func deleteCookie(w http.ResponseWriter) {
+	http.SetCookie(w, newSessionCookie("", -1))
+
+	//The cookies of old versions
 	cookie := http.Cookie{Name: "uid", Path: serverConf.DomainDir, MaxAge: -1}
 	http.SetCookie(w, &cookie)
 	cookie = http.Cookie{Name: "token", Path: serverConf.DomainDir, MaxAge: -1}
@@ -142,15 +167,25 @@ func httpCookieError(w http.ResponseWriter) {
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if _, sid, err := checkCookie(r); err == nil {
+		sessions.Delete(sid)
+	}
 	deleteCookie(w)
 	httpHead(w)
 	fmt.Fprintf(w, "已经退出登录")
 	httpTail(w)
 }
 
-func oAuthSuccess(auth *strava.AuthorizationResponse, w http.ResponseWriter, r *http.Request) {
-	addCookie(w, auth.AccessToken)
-	//http.Redirect(w, r, baseURL, 301)
+func oAuthSuccess(auth *StravaToken, next string, w http.ResponseWriter, r *http.Request) {
+	if err := addCookie(w, auth); err != nil {
+		httpLogger(r, 0).Error("oAuthSuccess addCookie", "athlete", auth.AthleteId, "err", err)
+		httpShowError(w, "登陆出错:"+err.Error())
+		return
+	}
+	if next != "" {
+		http.Redirect(w, r, serverConf.DomainDir+next, http.StatusFound)
+		return
+	}
 	httpReturnHome(w, "登陆成功")
 }
 
@@ -178,13 +213,18 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	// return
 	// }
 
-	uid, _, err := checkCookie(r)
+	uid, sid, err := checkCookie(r)
 	if err != nil {
 		deleteCookie(w)
 
 		//need login
 		httpHead(w)
-		fmt.Fprintf(w, `<a href="%s">访问Strava登陆</a><br>`, authenticator.AuthorizationURL("state1", strava.Permissions.Public, true))
+		if serverConf.LocalAccounts {
+			fmt.Fprintf(w, `<a href="%s">登陆</a><br>`, serverConf.DomainDir+web_login)
+			fmt.Fprintf(w, `<a href="%s">注册本地账号</a><br>`, serverConf.DomainDir+web_register)
+		} else {
+			fmt.Fprintf(w, `<a href="%s">访问Strava登陆</a><br>`, serverConf.DomainDir+web_login)
+		}
 		httpTail(w)
 		return
 	}
@@ -192,32 +232,69 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	httpHead(w)
 	fmt.Fprintf(w, `<a href="%s">退出登录</a><br><br>`, serverConf.DomainDir+web_logout)
 	fmt.Fprintf(w, `<a href="%s">图片管理</a><br><br>`, serverConf.DomainDir+web_photos)
+	fmt.Fprintf(w, `<a href="%s">轨迹管理</a><br><br>`, serverConf.DomainDir+web_tracks)
+	fmt.Fprintf(w, `<a href="%s">API令牌</a><br><br>`, serverConf.DomainDir+web_apitoken)
 
 	status, err := users.GetUserStatus(uid)
 	if err != nil {
-		log.Println(uid, "indexHandler users.GetUserStatus:", err)
+		httpLogger(r, uid).Error("indexHandler users.GetUserStatus", "err", err)
 		w.WriteHeader(403)
 	}
 
-	if status == UserMakingVideo {
-		fmt.Fprintf(w, `一个视频正在生成中<br><br>`)
+	cancel := fmt.Sprintf(`<form action="%s" method="post">%s<input type="submit" value="取消生成" /></form><br>`,
+		serverConf.DomainDir+web_cancel, csrfInput(sid))
+	//Update the progress and reload the page when the status is changed
+	fmt.Fprintf(w, `<script>
+	if (window.EventSource) {
+		var source = new EventSource('%s');
+		source.addEventListener('status', function(e) {
+			var p = JSON.parse(e.data);
+			var div = document.getElementById('progress');
+			if (p.Status == %d) {
+				if (div)
+					div.innerHTML = p.Info;
+				return;
+			}
+			source.close();
+			location.reload();
+		});
+	}
+	</script>`, serverConf.DomainDir+web_events, status)
+	if status == UserMakingVideo || status == UserWaitingVideo {
+		fmt.Fprintf(w, `<div id="progress">%s</div>`, progressInfo(getProgressStatus(uid, status)))
+		fmt.Fprintln(w, cancel)
 	} else {
 		fmt.Fprintf(w, `<a href="%s">生成视频</a><br><br>`, serverConf.DomainDir+web_makevideo)
 	}
 
-	video_dir := filepath.Join(users.dir, fmt.Sprintf("%d", uid), "v.mp4")
-	exist, err := fileIsExist(video_dir)
-	if err != nil {
-		log.Println(uid, "makevideoHandler fileIsExist:", video_dir, err)
-		w.WriteHeader(403)
-		return
-	}
-	if exist {
-		fmt.Fprintf(w, `<a href="%s">视频下载</a><br><br>`, serverConf.DomainDir+web_video)
+	if status == UserMakeVideoFail {
+		kind, reason := users.GetUserMakeVideoFail(uid)
+		fmt.Fprintf(w, `很遗憾，之前的视频生成出错了。<br>出错类型:%s<br>出错原因:%s<br><br>`, failKindInfo[kind], html.EscapeString(reason))
+	} else if status == UserMakeVideoCancel {
+		fmt.Fprintf(w, `之前的视频生成已经取消。<br><br>`)
 	}
 
-	if status == UserMakeVideoFail {
-		fmt.Fprintf(w, `很遗憾，之前的视频生成出错了。<br>出错原因:%s<br><br>`, users.GetUserMakeVideoFailReason(uid))
+	videos := users.GetVideos(uid)
+	if len(videos) > 0 {
+		show := `视频列表<hr>`
+		for i := len(videos) - 1; i >= 0; i-- {
+			video := videos[i]
+			show += html.EscapeString(video.Name) + ` ` + video.CreatedAt.Format(activity_layout) + ` ` + videoStatusInfo[video.Status]
+			if video.Status == VideoSuccess {
+				show += fmt.Sprintf(` <a href="%s?id=%d">下载</a>`, serverConf.DomainDir+web_video, video.Id)
+			}
+			if video.Status == VideoFail {
+				show += ` ` + failKindInfo[video.FailKind]
+				show += fmt.Sprintf(` <a href="%s?log=1&id=%d">日志</a>`, serverConf.DomainDir+web_video, video.Id)
+			}
+			if video.Status != VideoWaiting && video.Status != VideoMaking {
+				show += fmt.Sprintf(` <form action="%s?del=1&id=%d" method="post" style="display:inline">%s<input type="submit" value="删除" /></form>`,
+					serverConf.DomainDir+web_video, video.Id, csrfInput(sid))
+			}
+			show += `<br>`
+		}
+		show += `<hr>`
+		fmt.Fprintln(w, show)
 	}
 
 	fmt.Fprintln(w, `<a href="https://github.com/teawater/gps2video_web">关于</a>`)
@@ -225,26 +302,39 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func photosHandler(w http.ResponseWriter, r *http.Request) {
-	uid, _, err := checkCookie(r)
+	uid, sid, err := checkCookie(r)
 	if err != nil {
-		httpCookieError(w)
+		if r.Method == "POST" {
+			httpCookieError(w)
+		} else {
+			httpLoginRedirect(w, r, web_photos)
+		}
 		return
 	}
 
+	lg := httpLogger(r, uid)
+
 	photos_dir := filepath.Join(users.dir, fmt.Sprintf("%d", uid), "photos")
 	if dir_check_creat(photos_dir, true) != nil {
-		log.Println(uid, "photosHandler dir_check_creat:", err)
+		lg.Error("photosHandler dir_check_creat", "err", err)
 		w.WriteHeader(403)
 		return
 	}
 
 	r.ParseForm()
 	if r.Method == "POST" {
+		//The body of upload is read by MultipartReader, so the CSRF token
+		//of it is in the URL.
+		if !sessions.CheckCSRF(r, sid) {
+			httpCSRFError(w)
+			return
+		}
+
 		_, ok := r.Form["up"]
 		if ok {
 			reader, err := r.MultipartReader()
 			if err != nil {
-				log.Println(uid, "photosHandler MultipartReader:", err)
+				lg.Error("photosHandler MultipartReader", "err", err)
 				w.WriteHeader(403)
 				return
 			}
@@ -273,7 +363,7 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 					filename_tail++
 					exist, err := fileIsExist(filename)
 					if err != nil {
-						log.Println(uid, "photosHandler fileIsExist:", filename, err)
+						lg.Error("photosHandler fileIsExist", "file", filename, "err", err)
 						w.WriteHeader(403)
 						return
 					}
@@ -282,19 +372,13 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 
-				dst, err := os.Create(filename)
+				n, err := quotaCopy(uid, filename, part)
 				if err != nil {
-					log.Println(uid, "photosHandler os.Create:", filename, err)
-					w.WriteHeader(403)
-					return
-				}
-				if _, err := io.Copy(dst, part); err != nil {
-					log.Println(uid, "photosHandler io.Copy:", filename, err)
-					w.WriteHeader(403)
-
+					lg.Warn("photosHandler quotaCopy", "file", filename, "err", err)
+					httpShowError(w, "上传图片出错:"+err.Error())
 					return
 				}
-				dst.Close()
+				metricPhotoUploadBytes.Add(float64(n))
 			}
 		}
 
@@ -311,7 +395,7 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 				filename := filepath.Join(photos_dir, index+".jpg")
 				exist, err := fileIsExist(filename)
 				if err != nil {
-					log.Println(uid, "photosHandler fileIsExist:", filename, err)
+					lg.Error("photosHandler fileIsExist", "file", filename, "err", err)
 					w.WriteHeader(403)
 					return
 				}
@@ -320,7 +404,7 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 				}
 				err = os.Remove(filename)
 				if err != nil {
-					log.Println(uid, "photosHandler fileIsExist:", filename, err)
+					lg.Error("photosHandler fileIsExist", "file", filename, "err", err)
 					w.WriteHeader(403)
 					return
 				}
@@ -338,7 +422,7 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 			filename := filepath.Join(photos_dir, id+".jpg")
 			exist, err := fileIsExist(filename)
 			if err != nil {
-				log.Println(uid, "photosHandler fileIsExist:", filename, err)
+				lg.Error("photosHandler fileIsExist", "file", filename, "err", err)
 				w.WriteHeader(403)
 				return
 			}
@@ -368,7 +452,7 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 	if err != nil {
-		log.Println(uid, "filepath.Walk", err)
+		lg.Error("photosHandler filepath.Walk", "err", err)
 		w.WriteHeader(403)
 		return
 	}
@@ -376,6 +460,7 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 		show := `<form action="`
 		show += serverConf.DomainDir + web_photos
 		show += `?del=1" id="del_form" method="post">`
+		show += csrfInput(sid)
 		show += checkbox
 		show += `<a href="javascript:
 		var nodes = document.getElementById('del_form').childNodes;
@@ -398,7 +483,7 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 	up_form.appendChild(document.createElement('br'));">Add</a>`
 	show += `<form action="`
 	show += serverConf.DomainDir + web_photos
-	show += `?up=1" id="up_form" method="post" enctype="multipart/form-data">
+	show += `?up=1&` + csrfField + `=` + sessions.CSRFToken(sid) + `" id="up_form" method="post" enctype="multipart/form-data">
 	<input type="submit" value="Submit" /> <input type="reset" value="Reset" /><br>
 	<input type="file" name="file" id="file" accept="image/jpeg"/><br>
 	</form>`
@@ -406,22 +491,192 @@ func photosHandler(w http.ResponseWriter, r *http.Request) {
 	httpTail(w)
 }
 
-func videoHandler(w http.ResponseWriter, r *http.Request) {
+type ProgressStatus struct {
+	Status    int
+	Position  int
+	Stage     string
+	StageInfo string
+	Percent   int
+	FailKind  string
+	Reason    string
+	Info      string
+}
+
+func getProgressStatus(uid uint64, status int) (p ProgressStatus) {
+	p.Status = status
+	p.Percent = -1
+	switch status {
+	case UserWaitingVideo:
+		p.Position, _ = jobs.Position(uid)
+		p.FailKind, p.Reason = users.GetUserMakeVideoFail(uid)
+	case UserMakingVideo:
+		if progress, ok := jobs.GetProgress(uid); ok {
+			p.Stage = progress.Stage
+			p.StageInfo = progressStageInfo[progress.Stage]
+			p.Percent = progress.Percent
+		}
+	case UserMakeVideoFail:
+		p.FailKind, p.Reason = users.GetUserMakeVideoFail(uid)
+	}
+	p.Info = progressInfo(p)
+	return
+}
+
+func progressInfo(p ProgressStatus) (info string) {
+	switch p.Status {
+	case UserWaitingVideo:
+		if p.Position > 0 {
+			info = fmt.Sprintf(`视频正在排队等待生成，排在第%d位`, p.Position)
+		} else {
+			info = `视频正在排队等待生成`
+		}
+		if p.FailKind == FailInterrupted {
+			info += `<br>` + failKindInfo[p.FailKind]
+		}
+	case UserMakingVideo:
+		info = `一个视频正在生成中`
+		if p.StageInfo != "" {
+			info += `：` + p.StageInfo
+			if p.Percent >= 0 {
+				info += fmt.Sprintf(` %d%%`, p.Percent)
+			}
+		}
+	case UserMakeVideoFail:
+		info = `视频生成出错:` + failKindInfo[p.FailKind] + ` ` + html.EscapeString(p.Reason)
+	case UserMakeVideoCancel:
+		info = `视频生成已经取消`
+	}
+	return
+}
+
+func progressHandler(w http.ResponseWriter, r *http.Request) {
 	uid, _, err := checkCookie(r)
+	if err != nil {
+		w.WriteHeader(403)
+		return
+	}
+
+	status, err := users.GetUserStatus(uid)
+	if err != nil {
+		httpLogger(r, uid).Error("progressHandler users.GetUserStatus", "err", err)
+		w.WriteHeader(403)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err = json.NewEncoder(w).Encode(getProgressStatus(uid, status)); err != nil {
+		httpLogger(r, uid).Warn("progressHandler json.Encode", "err", err)
+	}
+}
+
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	uid, sid, err := checkCookie(r)
+	if err != nil {
+		httpCookieError(w)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(403)
+		return
+	}
+	r.ParseForm()
+	if !sessions.CheckCSRF(r, sid) {
+		httpCSRFError(w)
+		return
+	}
+
+	if err = jobs.Cancel(uid); err != nil {
+		httpLogger(r, uid).Warn("cancelHandler jobs.Cancel", "err", err)
+		httpShowError(w, "取消出错:"+err.Error())
+		return
+	}
+
+	httpReturnHome(w, "已经取消生成视频")
+}
+
+func apitokenHandler(w http.ResponseWriter, r *http.Request) {
+	uid, sid, err := checkCookie(r)
 	if err != nil {
 		httpCookieError(w)
 		return
 	}
 
-	video_dir := filepath.Join(users.dir, fmt.Sprintf("%d", uid), "v.mp4")
+	if r.Method == "POST" {
+		r.ParseForm()
+		if !sessions.CheckCSRF(r, sid) {
+			httpCSRFError(w)
+			return
+		}
+	}
+
+	token, err := users.GetApiToken(uid, r.Method == "POST")
+	if err != nil {
+		httpLogger(r, uid).Error("apitokenHandler users.GetApiToken", "err", err)
+		httpShowError(w, "系统出错:"+err.Error())
+		return
+	}
+
+	httpHead(w)
+	show := `<a href="` + serverConf.DomainDir + `">返回</a><hr>`
+	show += `API令牌:` + token + `<br>`
+	show += `API地址:` + baseURL + web_api + `<br>`
+	show += `使用时需要设置HTTP头 "Authorization: Bearer API令牌"<br><br>`
+	show += `<form action="` + serverConf.DomainDir + web_apitoken + `" method="post">`
+	show += csrfInput(sid)
+	show += `<input type="submit" value="重新生成令牌" /></form>`
+	fmt.Fprintln(w, show)
+	httpTail(w)
+}
+
+func videoHandler(w http.ResponseWriter, r *http.Request) {
+	uid, sid, err := checkCookie(r)
+	if err != nil {
+		httpCookieError(w)
+		return
+	}
+
+	r.ParseForm()
+	vid, err := strconv.ParseUint(formGetOne(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(403)
+		return
+	}
+
+	if r.Method == "POST" {
+		if !sessions.CheckCSRF(r, sid) {
+			httpCSRFError(w)
+			return
+		}
+		_, ok := r.Form["del"]
+		if !ok {
+			w.WriteHeader(403)
+			return
+		}
+		if err = users.DelVideo(uid, vid); err != nil {
+			httpLogger(r, uid).Warn("videoHandler users.DelVideo", "job", vid, "err", err)
+			httpShowError(w, "删除视频出错:"+err.Error())
+			return
+		}
+		httpReturnHome(w, "视频已删除")
+		return
+	}
+
+	video_dir := filepath.Join(users.VideoDir(uid, vid), "v.mp4")
+	if _, ok := r.Form["log"]; ok {
+		video_dir = filepath.Join(users.VideoDir(uid, vid), "log.txt")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
 	exist, err := fileIsExist(video_dir)
 	if err != nil {
-		log.Println(uid, "makevideoHandler fileIsExist:", video_dir, err)
+		httpLogger(r, uid).Error("videoHandler fileIsExist", "job", vid, "file", video_dir, "err", err)
 		w.WriteHeader(403)
 		return
 	}
 	if !exist {
 		httpReturnHome(w, "没有文件")
+		return
 	}
 
 	http.ServeFile(w, r, video_dir)
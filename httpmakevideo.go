@@ -1,17 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/mail"
 	"net/smtp"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -59,6 +61,35 @@ func (this *BaseOption) Getrequired() bool {
 	return this.required
 }
 
+//Description of an option in JSON Schema
+type OptionSchema struct {
+	Type        string      `json:"type"`
+	Title       string      `json:"title,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Minimum     *float64    `json:"minimum,omitempty"`
+	Maximum     *float64    `json:"maximum,omitempty"`
+	MultipleOf  float64     `json:"multipleOf,omitempty"`
+	Enum        []string    `json:"enum,omitempty"`
+	EnumNames   []string    `json:"enumNames,omitempty"`
+}
+
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+//Convert longInfo to plain text
+func html2Text(html string) string {
+	html = strings.Replace(html, "<br>", "\n", -1)
+	return htmlTagRegexp.ReplaceAllString(html, "")
+}
+
+func (this *BaseOption) GetSchema() *OptionSchema {
+	return &OptionSchema{
+		Type:        "string",
+		Title:       this.shortInfo,
+		Description: html2Text(this.longInfo),
+	}
+}
+
 func (this *BaseOption) FormHaveData(form []string) bool {
 	if len(form) < 1 {
 		return false
@@ -93,11 +124,26 @@ type Int64Option struct {
 	max        int64 //If set to 0, will not check max
 }
 
-func (this *Int64Option) GetHtmlInput(service *strava.CurrentAthleteService, index string) (html string, err error) {
+func (this *Int64Option) GetHtmlInput(service *strava.CurrentAthleteService, index string, uid uint64) (html string, err error) {
 	html = `<input type="text" name="` + index + `" value="` + this.defaultVal + `">`
 	return
 }
 
+func (this *Int64Option) GetSchema() *OptionSchema {
+	schema := this.BaseOption.GetSchema()
+	schema.Type = "integer"
+	if num, err := strconv.ParseInt(this.defaultVal, 10, 64); err == nil {
+		schema.Default = num
+	}
+	min := float64(this.min)
+	schema.Minimum = &min
+	if this.max != 0 {
+		max := float64(this.max)
+		schema.Maximum = &max
+	}
+	return schema
+}
+
 func (this *Int64Option) Form2Int64(form []string) (num int64, err error) {
 	str, err := this.Form2String(form)
 	if err != nil {
@@ -129,20 +175,49 @@ type TrackIdOption struct {
 	Int64Option
 }
 
-func (this *TrackIdOption) GetHtmlInput(service *strava.CurrentAthleteService, index string) (html string, err error) {
-	activities, err := service.ListActivities().Do()
+func (this *TrackIdOption) GetHtmlInput(service *strava.CurrentAthleteService, index string, uid uint64) (html string, err error) {
+	activities, note, err := listActivities(uid)
 	if err != nil {
-		err = errors.New("strava出错:" + err.Error())
 		return
 	}
 
-	html += `<select name="` + index + `">`
-	for _, activity := range activities {
-		html += `<option value="` + fmt.Sprintf("%d", activity.Id) + `">`
-		html += activity.Name + activity.StartDateLocal.Format(activity_layout)
-		html += `</option>`
+	html = activityPickerHtml(index, activities)
+	if note != "" {
+		html += `<br>` + note
 	}
-	html += `</select>`
+	html += fmt.Sprintf(` <a href="%s?refresh=1">刷新Strava活动列表</a>`, serverConf.DomainDir+web_makevideo)
+	return
+}
+
+//The Strava activities are positive, the uploaded tracks are negative
+func (this *TrackIdOption) GetSchema() *OptionSchema {
+	schema := this.Int64Option.GetSchema()
+	schema.Minimum = nil
+	schema.Description = "Strava活动的ID，或者上传的轨迹的ID（负数）"
+	return schema
+}
+
+func (this *TrackIdOption) Form2Config(form []string, uid uint64) (config string, err error) {
+	var num int64
+	if num, err = this.Form2Int64(form); err != nil {
+		return
+	}
+	if num == 0 {
+		err = errors.New("没有选择轨迹")
+		return
+	}
+	if num < 0 {
+		var exist bool
+		if exist, err = fileIsExist(trackFile(uid, num)); err != nil {
+			return
+		}
+		if !exist {
+			err = fmt.Errorf("没有上传的轨迹%d", num)
+			return
+		}
+	}
+
+	config = fmt.Sprintf("%s=%d\n", this.configName, num)
 	return
 }
 
@@ -150,11 +225,17 @@ type Float64Option struct {
 	BaseOption
 }
 
-func (this *Float64Option) GetHtmlInput(service *strava.CurrentAthleteService, index string) (html string, err error) {
+func (this *Float64Option) GetHtmlInput(service *strava.CurrentAthleteService, index string, uid uint64) (html string, err error) {
 	html = `<input type="text" name="` + index + `" value="">`
 	return
 }
 
+func (this *Float64Option) GetSchema() *OptionSchema {
+	schema := this.BaseOption.GetSchema()
+	schema.Type = "number"
+	return schema
+}
+
 func (this *Float64Option) Form2Float64(form []string) (num float64, err error) {
 	str, err := this.Form2String(form)
 	if err != nil {
@@ -168,14 +249,25 @@ type PhotosTimezoneOption struct {
 	Float64Option
 }
 
-func (this *PhotosTimezoneOption) Float642Config(num float64) (config string, err error) {
-	fi, f := math.Modf(num)
-	i := int64(fi)
+func (this *PhotosTimezoneOption) GetSchema() *OptionSchema {
+	schema := this.Float64Option.GetSchema()
+	min := float64(-12)
+	max := 13.5
+	schema.Minimum = &min
+	schema.Maximum = &max
+	schema.MultipleOf = 0.5
+	return schema
+}
 
-	if i < -12 || i > 13 || (f != 0 && f != 0.5) {
+func (this *PhotosTimezoneOption) Float642Config(num float64) (config string, err error) {
+	//Check with the bounds that are sent to the form
+	schema := this.GetSchema()
+	if num < *schema.Minimum || num > *schema.Maximum || math.Mod(num, schema.MultipleOf) != 0 {
 		err = fmt.Errorf("格式不对")
 		return
 	}
+	fi, f := math.Modf(num)
+	i := int64(fi)
 
 	if f == 0 {
 		config = fmt.Sprintf("%s=%d\n", this.configName, i)
@@ -203,7 +295,7 @@ type ListOption struct {
 	Info       []string
 }
 
-func (this *ListOption) GetHtmlInput(service *strava.CurrentAthleteService, index string) (html string, err error) {
+func (this *ListOption) GetHtmlInput(service *strava.CurrentAthleteService, index string, uid uint64) (html string, err error) {
 	for i := range this.Info {
 		checked := ""
 		if this.Val[i] == this.defaultVal {
@@ -215,6 +307,16 @@ func (this *ListOption) GetHtmlInput(service *strava.CurrentAthleteService, inde
 	return
 }
 
+func (this *ListOption) GetSchema() *OptionSchema {
+	schema := this.BaseOption.GetSchema()
+	schema.Default = this.defaultVal
+	schema.Enum = this.Val
+	for _, info := range this.Info {
+		schema.EnumNames = append(schema.EnumNames, html2Text(info))
+	}
+	return schema
+}
+
 type PhotosOption struct {
 	ListOption
 }
@@ -234,7 +336,7 @@ func (this *PhotosOption) Form2Config(form []string, uid uint64) (config string,
 		photos_dir = filepath.Join(users.dir, fmt.Sprintf("%d", uid), "photos")
 		err = dir_check_creat(photos_dir, true)
 		if err != nil {
-			log.Println(uid, "PhotosOption Form2Config dir_check_creat:", err)
+			slog.Error("PhotosOption Form2Config dir_check_creat", "uid", uid, "err", err)
 			return
 		}
 	} else {
@@ -254,7 +356,7 @@ func (this *BoolOption) FormHaveData(form []string) bool {
 	return true
 }
 
-func (this *BoolOption) GetHtmlInput(service *strava.CurrentAthleteService, index string) (html string, err error) {
+func (this *BoolOption) GetHtmlInput(service *strava.CurrentAthleteService, index string, uid uint64) (html string, err error) {
 	checked := ""
 	if this.defaultVal {
 		checked = ` checked="checked"`
@@ -264,6 +366,13 @@ func (this *BoolOption) GetHtmlInput(service *strava.CurrentAthleteService, inde
 	return
 }
 
+func (this *BoolOption) GetSchema() *OptionSchema {
+	schema := this.BaseOption.GetSchema()
+	schema.Type = "boolean"
+	schema.Default = this.defaultVal
+	return schema
+}
+
 func (this *BoolOption) Form2Bool(form []string) bool {
 	if len(form) < 1 {
 		return false
@@ -287,7 +396,8 @@ type MakevideoOptioner interface {
 	GetlongInfo() string
 	Getrequired() bool
 
-	GetHtmlInput(service *strava.CurrentAthleteService, index string) (html string, err error)
+	GetHtmlInput(service *strava.CurrentAthleteService, index string, uid uint64) (html string, err error)
+	GetSchema() *OptionSchema
 
 	FormHaveData(form []string) bool
 	Form2Config(form []string, uid uint64) (config string, err error)
@@ -411,233 +521,346 @@ type MakeVideoOptions struct {
 	UseStravaPhotos bool
 	StravaPhotoSize int64
 	SendEmail       bool
+	VideoId         uint64
 }
 
-func makevideoHandler(w http.ResponseWriter, r *http.Request) {
-	uid, token, err := checkCookie(r)
+//Check the options in form and add a job to make the video.
+//The error can be shown to the user.
+func makevideoSubmit(uid uint64, token string, form url.Values) (vid uint64, err error) {
+	status, err := users.GetUserStatus(uid)
 	if err != nil {
-		httpCookieError(w)
 		return
 	}
-
-	status, err := users.GetUserStatus(uid)
-	if err != nil {
-		log.Println(uid, "makevideoHandler users.GetUserStatus:", err)
-		w.WriteHeader(403)
+	if status == UserMakingVideo || status == UserWaitingVideo {
+		err = errors.New("正在生成一个视频")
+		return
 	}
-	if status == UserMakingVideo {
-		httpReturnHome(w, "正在生成一个视频")
+	if err = quotaCheck(uid); err != nil {
 		return
 	}
 
-	client := strava.NewClient(token)
-
-	if r.Method == "POST" {
-		moptions := new(MakeVideoOptions)
-
-		r.ParseForm()
-
-		output_dir := filepath.Join(users.dir, fmt.Sprintf("%d", uid), "output")
-		if dir_check_creat(output_dir, true) != nil {
-			log.Println(uid, "makevideoHandler dir_check_creat:", err)
-			w.WriteHeader(403)
-			return
-		}
+	client := strava.NewClient(token, stravaHTTPClient)
+	moptions := new(MakeVideoOptions)
 
-		var video_width, video_height, video_border int64
+	//The values will be changed
+	values := make(url.Values)
+	for index, val := range form {
+		values[index] = val
+	}
 
-		gpx_name := filepath.Join(output_dir, "g2v.gpx")
+	output_dir := filepath.Join(users.UserDir(uid), "output")
 
-		config := "[required]\n"
-		config += "ffmpeg=" + serverConf.Ffmpeg + "\n"
-		config += "google_map_key=" + serverConf.Google_map_key + "\n"
-		config += "gps_file=" + gpx_name + "\n"
-		config += "google_map_type=satellite\n"
-		for index, option := range makevideoOptions {
-			if !option.Getrequired() {
-				continue
-			}
-			form, ok := r.Form[index]
-			if !ok {
-				httpShowError(w, option.GetshortInfo()+"没有设置")
-				return
-			}
-			c, err := option.Form2Config(form, uid)
-			if err != nil {
-				httpShowError(w, option.GetshortInfo()+err.Error())
-				return
-			}
-			config += c
-
-			if index == "video_width" || index == "video_height" || index == "video_border" || index == "trackid" {
-				var num int64
-				var err error
-				if index == "trackid" {
-					num, err = option.(*TrackIdOption).Form2Int64(form)
-				} else {
-					num, err = option.(*Int64Option).Form2Int64(form)
-				}
-				if err != nil {
-					httpShowError(w, option.GetshortInfo()+err.Error())
-					return
-				}
-				switch index {
-				case "video_width":
-					video_width = num
-				case "video_height":
-					video_height = num
-				case "video_border":
-					video_border = num
-				case "trackid":
-					moptions.TrackId = num
-				}
-			}
+	var video_width, video_height, video_border int64
 
-			delete(r.Form, index)
+	config := ""
+	for index, option := range makevideoOptions {
+		if !option.Getrequired() {
+			continue
 		}
-
-		//Special check for video_width, video_height, video_border
-		b_tmp := video_border * 2
-		if b_tmp >= video_width || b_tmp >= video_height {
-			httpShowError(w, "你把边框宽度设置这么大浏览器会爆炸的")
+		form, ok := values[index]
+		if !ok {
+			err = errors.New(option.GetshortInfo() + "没有设置")
 			return
 		}
-		if video_width > video_height {
-			moptions.StravaPhotoSize = video_width
-		} else {
-			moptions.StravaPhotoSize = video_height
+		c, e := option.Form2Config(form, uid)
+		if e != nil {
+			err = errors.New(option.GetshortInfo() + e.Error())
+			return
 		}
-
-		gotPhotosTimezoneOption := false
-		config += "[optional]\n"
-		for index, form := range r.Form {
-			option, ok := makevideoOptions[index]
-			if !ok {
-				continue
+		config += c
+
+		if index == "video_width" || index == "video_height" || index == "video_border" || index == "trackid" {
+			var num int64
+			if index == "trackid" {
+				num, err = option.(*TrackIdOption).Form2Int64(form)
+			} else {
+				num, err = option.(*Int64Option).Form2Int64(form)
 			}
-			if !option.FormHaveData(form) {
-				continue
-			}
-			c, err := option.Form2Config(form, uid)
 			if err != nil {
-				httpShowError(w, option.GetshortInfo()+err.Error())
+				err = errors.New(option.GetshortInfo() + err.Error())
 				return
 			}
-			config += c
-
 			switch index {
-			case "photos_timezone":
-				gotPhotosTimezoneOption = true
-			case "photos_dir":
-				photo, _ := option.(*PhotosOption).Form2String(form)
-				if photo == "strava" {
-					moptions.UseStravaPhotos = true
-				}
-			case "sendemail":
-				moptions.SendEmail = option.(*SendEmailOption).Form2Bool(form)
+			case "video_width":
+				video_width = num
+			case "video_height":
+				video_height = num
+			case "video_border":
+				video_border = num
+			case "trackid":
+				moptions.TrackId = num
 			}
 		}
-		//Get activity.StartDate and activity.StartDateLocal
-		activity, err := strava.NewActivitiesService(client).Get(moptions.TrackId).IncludeAllEfforts().Do()
-		if err != nil {
-			httpShowError(w, "strava出错:"+err.Error())
+
+		delete(values, index)
+	}
+
+	//Special check for video_width, video_height, video_border
+	b_tmp := video_border * 2
+	if b_tmp >= video_width || b_tmp >= video_height {
+		err = errors.New("你把边框宽度设置这么大浏览器会爆炸的")
+		return
+	}
+	if video_width > video_height {
+		moptions.StravaPhotoSize = video_width
+	} else {
+		moptions.StravaPhotoSize = video_height
+	}
+
+	gotPhotosTimezoneOption := false
+	config += "[optional]\n"
+	for index, form := range values {
+		option, ok := makevideoOptions[index]
+		if !ok {
+			continue
+		}
+		if !option.FormHaveData(form) {
+			continue
+		}
+		c, e := option.Form2Config(form, uid)
+		if e != nil {
+			err = errors.New(option.GetshortInfo() + e.Error())
 			return
 		}
-		if !gotPhotosTimezoneOption {
-			c, _ := photosTimezoneOption.Float642Config(activity.StartDateLocal.Sub(activity.StartDate).Hours())
-			config += c + "\n"
+		config += c
+
+		switch index {
+		case "photos_timezone":
+			gotPhotosTimezoneOption = true
+		case "photos_dir":
+			photo, _ := option.(*PhotosOption).Form2String(form)
+			if photo == "strava" {
+				moptions.UseStravaPhotos = true
+			}
+		case "sendemail":
+			moptions.SendEmail = option.(*SendEmailOption).Form2Bool(form)
 		}
-
-		config += "output_dir=" + output_dir + "\n"
-
-		config_name := filepath.Join(output_dir, "config.ini")
-		config_fp, err := os.Create(config_name)
-		if err != nil {
-			log.Println(uid, "makevideoHandler os.Create:", config_name, err)
-			httpShowError(w, "系统出错:"+err.Error())
+	}
+	//Get the name, the start time and the timezone of the track
+	var track_name string
+	var start_date time.Time
+	var timezone float64
+	var uploaded *gpx.GPX
+	if moptions.TrackId < 0 {
+		if moptions.UseStravaPhotos {
+			err = errors.New("上传的轨迹不能使用Strava的照片")
 			return
 		}
-		_, err = fmt.Fprintln(config_fp, config)
-		config_fp.Close()
-		if err != nil {
-			log.Println(uid, "makevideoHandler fmt.Fprintln:", config_name, err)
-			httpShowError(w, "系统出错:"+err.Error())
+		if uploaded, err = loadTrack(uid, moptions.TrackId); err != nil {
+			err = errors.New("读取上传的轨迹出错:" + err.Error())
 			return
 		}
-
-		//Track
-		streams, err := strava.NewActivityStreamsService(client).Get(moptions.TrackId, []strava.StreamType{strava.StreamTypes.Location,
-			strava.StreamTypes.Elevation,
-			strava.StreamTypes.Time}).Do()
-		if err != nil {
-			httpShowError(w, "strava出错:"+err.Error())
+		track_name = uploaded.Name
+		start_date = uploaded.TimeBounds().StartTime
+		//The uploaded tracks don't have the timezone, use the one of the server
+		_, offset := start_date.In(time.Local).Zone()
+		timezone = float64(offset) / 3600
+	} else {
+		if token == "" {
+			err = errNoStrava
 			return
 		}
-		streams_len := len(streams.Time.Data)
-		if streams_len != len(streams.Location.Data) || streams_len != len(streams.Elevation.Data) {
-			httpShowError(w, "strava提供轨迹数据有错")
+		activity, e := strava.NewActivitiesService(client).Get(moptions.TrackId).IncludeAllEfforts().Do()
+		if e != nil {
+			err = errors.New("strava出错:" + e.Error())
 			return
 		}
+		track_name = activity.Name
+		start_date = activity.StartDate
+		timezone = activity.StartDateLocal.Sub(activity.StartDate).Hours()
+	}
+	if !gotPhotosTimezoneOption {
+		c, _ := photosTimezoneOption.Float642Config(timezone)
+		config += c + "\n"
+	}
 
-		gpx_file := new(gpx.GPX)
-		for i := 0; i < streams_len; i++ {
-			if len(streams.Location.Data[i]) != 2 {
-				httpShowError(w, "strava提供轨迹数据有错")
-				return
-			}
-			gpx_file.AppendPoint(
-				&gpx.GPXPoint{
-					Point: gpx.Point{
-						Latitude:  streams.Location.Data[i][0],
-						Longitude: streams.Location.Data[i][1],
-						Elevation: *gpx.NewNullableFloat64(streams.Elevation.Data[i]),
-					},
-					Timestamp: activity.StartDate.Add(time.Duration(streams.Time.Data[i]) * time.Second),
-				})
-		}
-		gpxBytes, err := gpx_file.ToXml(gpx.ToXmlParams{Version: "1.1", Indent: true})
-		if err != nil {
-			log.Println(uid, "makevideoHandler gpx_file.ToXml:", err)
-			httpShowError(w, "系统出错:"+err.Error())
-			return
+	config += "output_dir=" + output_dir + "\n"
+
+	//Each video has its own directory that keeps config.ini, g2v.gpx,
+	//the log and the video
+	vid, err = users.AddVideo(uid, moptions.TrackId, track_name)
+	if err != nil {
+		slog.Error("makevideoSubmit users.AddVideo", "uid", uid, "activity", moptions.TrackId, "err", err)
+		err = errors.New("系统出错:" + err.Error())
+		return
+	}
+	moptions.VideoId = vid
+	lg := jobLogger(uid, moptions)
+	queued := false
+	defer func() {
+		if !queued {
+			users.DelVideo(uid, vid)
 		}
+	}()
+	video_dir := users.VideoDir(uid, vid)
+	gpx_name := filepath.Join(video_dir, "g2v.gpx")
+
+	config = "[required]\n" +
+		"ffmpeg=" + serverConf.Ffmpeg + "\n" +
+		"google_map_key=" + serverConf.Google_map_key + "\n" +
+		"gps_file=" + gpx_name + "\n" +
+		"google_map_type=satellite\n" +
+		config
+
+	config_name := filepath.Join(video_dir, "config.ini")
+	config_fp, err := os.Create(config_name)
+	if err != nil {
+		lg.Error("makevideoSubmit os.Create", "file", config_name, "err", err)
+		err = errors.New("系统出错:" + err.Error())
+		return
+	}
+	_, err = fmt.Fprintln(config_fp, config)
+	config_fp.Close()
+	if err != nil {
+		lg.Error("makevideoSubmit fmt.Fprintln", "file", config_name, "err", err)
+		err = errors.New("系统出错:" + err.Error())
+		return
+	}
 
-		//Write to gpx_name
-		gpx_fp, err := os.Create(gpx_name)
+	//Track
+	gpx_file := uploaded
+	if gpx_file == nil {
+		gpx_file, err = stravaTrack(client, moptions.TrackId, start_date)
 		if err != nil {
-			log.Println(uid, "makevideoHandler os.Create:", gpx_name, err)
-			httpShowError(w, "系统出错:"+err.Error())
 			return
 		}
-		_, err = gpx_fp.Write(gpxBytes)
-		gpx_fp.Close()
-		if err != nil {
-			log.Println(uid, "makevideoHandler gpx_fp.Write:", gpx_name, err)
-			httpShowError(w, "系统出错:"+err.Error())
-			return
+	}
+	gpxBytes, err := gpx_file.ToXml(gpx.ToXmlParams{Version: "1.1", Indent: true})
+	if err != nil {
+		lg.Error("makevideoSubmit gpx_file.ToXml", "err", err)
+		err = errors.New("系统出错:" + err.Error())
+		return
+	}
+
+	//Write to gpx_name
+	gpx_fp, err := os.Create(gpx_name)
+	if err != nil {
+		lg.Error("makevideoSubmit os.Create", "file", gpx_name, "err", err)
+		err = errors.New("系统出错:" + err.Error())
+		return
+	}
+	_, err = gpx_fp.Write(gpxBytes)
+	gpx_fp.Close()
+	if err != nil {
+		lg.Error("makevideoSubmit gpx_fp.Write", "file", gpx_name, "err", err)
+		err = errors.New("系统出错:" + err.Error())
+		return
+	}
+
+	//Another request of uid might have added a job after the check at the
+	//beginning
+	rollback, err := users.StartJob(uid, moptions)
+	if err != nil {
+		lg.Warn("makevideoSubmit users.StartJob", "err", err)
+		return
+	}
+
+	if err = jobs.Add(uid, moptions); err != nil {
+		lg.Warn("makevideoSubmit jobs.Add", "err", err)
+		if e := users.AbortJob(uid, vid, rollback); e != nil {
+			lg.Error("makevideoSubmit users.AbortJob", "err", e)
 		}
+		err = errors.New("加入队列出错:" + err.Error())
+		return
+	}
 
-		err = users.SetUserStatus(uid, UserMakingVideo, moptions, "")
-		if err != nil {
-			log.Println(uid, "makevideoHandler users.GetUserStatus:", err)
-			w.WriteHeader(403)
+	queued = true
+	return
+}
+
+//Get the track of Strava activity id that started at start_date
+func stravaTrack(client *strava.Client, id int64, start_date time.Time) (gpx_file *gpx.GPX, err error) {
+	streams, err := strava.NewActivityStreamsService(client).Get(id, []strava.StreamType{strava.StreamTypes.Location,
+		strava.StreamTypes.Elevation,
+		strava.StreamTypes.Time}).Do()
+	if err != nil {
+		err = errors.New("strava出错:" + err.Error())
+		return
+	}
+	streams_len := len(streams.Time.Data)
+	if streams_len != len(streams.Location.Data) || streams_len != len(streams.Elevation.Data) {
+		err = errors.New("strava提供轨迹数据有错")
+		return
+	}
+
+	gpx_file = new(gpx.GPX)
+	for i := 0; i < streams_len; i++ {
+		if len(streams.Location.Data[i]) != 2 {
+			err = errors.New("strava提供轨迹数据有错")
+			gpx_file = nil
 			return
 		}
+		gpx_file.AppendPoint(
+			&gpx.GPXPoint{
+				Point: gpx.Point{
+					Latitude:  streams.Location.Data[i][0],
+					Longitude: streams.Location.Data[i][1],
+					Elevation: *gpx.NewNullableFloat64(streams.Elevation.Data[i]),
+				},
+				Timestamp: start_date.Add(time.Duration(streams.Time.Data[i]) * time.Second),
+			})
+	}
+	return
+}
 
-		httpReturnHome(w, "开始生成")
+func makevideoHandler(w http.ResponseWriter, r *http.Request) {
+	uid, sid, err := checkCookie(r)
+	if err != nil {
+		if r.Method == "POST" {
+			httpCookieError(w)
+		} else {
+			httpLoginRedirect(w, r, web_makevideo)
+		}
+		return
+	}
 
-		go makeVideo(uid, token, moptions)
+	//The local accounts don't have the token
+	token, err := users.GetToken(uid)
+	if err != nil && err != errNoStrava {
+		httpShowError(w, err.Error())
+		return
+	}
 
+	status, err := users.GetUserStatus(uid)
+	if err != nil {
+		httpLogger(r, uid).Error("makevideoHandler users.GetUserStatus", "err", err)
+		w.WriteHeader(403)
+	}
+	if status == UserMakingVideo || status == UserWaitingVideo {
+		httpReturnHome(w, "正在生成一个视频")
+		return
+	}
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		if !sessions.CheckCSRF(r, sid) {
+			httpCSRFError(w)
+			return
+		}
+		if _, err = makevideoSubmit(uid, token, r.Form); err != nil {
+			httpShowError(w, err.Error())
+			return
+		}
+		httpReturnHome(w, "已经加入生成视频的队列")
 		return
 	}
 
-	service := strava.NewCurrentAthleteService(client)
+	r.ParseForm()
+	if formGetOne(r, "refresh") != "" {
+		activityCache.Refresh(uid)
+	}
+
+	var service *strava.CurrentAthleteService
+	if token != "" {
+		service = strava.NewCurrentAthleteService(strava.NewClient(token, stravaHTTPClient))
+	}
 
 	httpHead(w)
 	show := `带*的为必填项<br><br>`
 	show += `<form action="`
 	show += serverConf.DomainDir + web_makevideo
 	show += `" method="post">`
+	show += csrfInput(sid)
 	for _, index := range show_index {
 		option := makevideoOptions[index]
 		if !option.Show() {
@@ -650,7 +873,7 @@ func makevideoHandler(w http.ResponseWriter, r *http.Request) {
 		if option.GetlongInfo() != "" {
 			show += option.GetlongInfo() + `<br>`
 		}
-		html, err := option.GetHtmlInput(service, index)
+		html, err := option.GetHtmlInput(service, index, uid)
 		if err != nil {
 			httpShowError(w, err.Error())
 			return
@@ -663,120 +886,244 @@ func makevideoHandler(w http.ResponseWriter, r *http.Request) {
 	httpTail(w)
 }
 
-func makeVideo(uid uint64, token string, options *MakeVideoOptions) {
+//Make the video of options.  interrupted is true if it was killed by the
+//shutdown, then the status is set back to waiting with FailInterrupted
+//and the job should be put back to the queue.
+func makeVideo(ctx context.Context, uid uint64, options *MakeVideoOptions) (interrupted bool) {
+	if serverConf.MakeVideoTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(serverConf.MakeVideoTimeout)*time.Second)
+		defer cancel()
+	}
+
+	lg := jobLogger(uid, options)
+	start := time.Now()
 	status := UserMakeVideoFail
-	var reason string
+	fail := &FailInfo{Kind: FailSystem, Reason: failKindInfo[FailSystem]}
 	defer func() {
-		err := users.SetUserStatus(uid, status, nil, reason)
+		if status != UserNormal && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			lg.Warn("makeVideo timeout")
+			tail := ""
+			if fail != nil {
+				tail = fail.Tail
+			}
+			fail = &FailInfo{
+				Kind:   FailTimeout,
+				Reason: fmt.Sprintf("生成视频超过了%d秒", serverConf.MakeVideoTimeout),
+				Tail:   tail,
+			}
+		}
+
+		//Everything that failed after the job was cancelled is because of the cancel
+		if status != UserNormal && errors.Is(ctx.Err(), context.Canceled) {
+			if errors.Is(context.Cause(ctx), errShutdown) {
+				//Make it again after restart
+				lg.Warn("makeVideo interrupted by shutdown")
+				interrupted = true
+				status = UserWaitingVideo
+				fail = &FailInfo{Kind: FailInterrupted, Reason: failKindInfo[FailInterrupted]}
+			} else {
+				lg.Info("makeVideo cancelled")
+				status = UserMakeVideoCancel
+			}
+			os.RemoveAll(filepath.Join(users.UserDir(uid), "output"))
+		}
+
+		err := users.SetJobStatus(uid, options.VideoId, status, fail)
 		if err != nil {
-			log.Println(uid, "makeVideo users.SetUserStatus:", err)
+			lg.Error("makeVideo users.SetJobStatus", "err", err)
+		}
+		if interrupted {
+			return
 		}
+		metricsRender(status, fail, time.Since(start))
 
-		if options.SendEmail {
-			sendMail(uid, token, status, reason)
+		if options.SendEmail && status != UserMakeVideoCancel {
+			sendMail(uid, options.VideoId, status, fail)
 		}
 	}()
 
-	output_dir := filepath.Join(users.dir, fmt.Sprintf("%d", uid), "output")
+	output_dir := filepath.Join(users.UserDir(uid), "output")
 	config_dir := filepath.Join(output_dir, "config.ini")
+	video_dir := users.VideoDir(uid, options.VideoId)
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	//Get a clean output_dir and copy config.ini of the video to it
+	os.RemoveAll(output_dir)
+	if err := dir_check_creat(output_dir, true); err != nil {
+		lg.Error("makeVideo dir_check_creat", "dir", output_dir, "err", err)
+		return
+	}
+	if err := quotaCheck(uid); err != nil {
+		lg.Warn("makeVideo quotaCheck", "err", err)
+		fail = &FailInfo{Kind: FailQuota, Reason: err.Error()}
+		return
+	}
+	config, err := os.ReadFile(filepath.Join(video_dir, "config.ini"))
+	if err != nil {
+		lg.Error("makeVideo os.ReadFile", "dir", video_dir, "err", err)
+		return
+	}
+	if err = os.WriteFile(config_dir, config, 0600); err != nil {
+		lg.Error("makeVideo os.WriteFile", "file", config_dir, "err", err)
+		return
+	}
+
+	job := &RenderJob{
+		Uid:        uid,
+		VideoId:    options.VideoId,
+		OutputDir:  output_dir,
+		ConfigFile: config_dir,
+		LogFile:    filepath.Join(video_dir, "log.txt"),
+	}
+	if err = renderer.Prepare(job); err != nil {
+		lg.Error("makeVideo renderer.Prepare", "err", err)
+		fail = renderFailInfo(err)
+		return
+	}
 
 	if options.UseStravaPhotos {
-		reason = "从Strava下载照片出错"
+		fail = &FailInfo{Kind: FailPhoto, Reason: "从Strava下载照片出错"}
 
 		photos_dir := filepath.Join(output_dir, "photos")
 		os.RemoveAll(photos_dir)
 		err := dir_check_creat(photos_dir, true)
 		if err != nil {
-			log.Println("makeVideo dir_check_creat:", photos_dir, err)
+			lg.Error("makeVideo dir_check_creat", "dir", photos_dir, "err", err)
 			return
 		}
 
-		photos, err := strava.NewActivitiesService(strava.NewClient(token)).ListPhotos(options.TrackId).Size(uint(options.StravaPhotoSize)).Do()
+		token, err := users.GetToken(uid)
 		if err != nil {
-			log.Println("makeVideo ListPhotos:", photos_dir, err)
+			lg.Error("makeVideo users.GetToken", "err", err)
+			fail = &FailInfo{Kind: FailStrava, Reason: err.Error()}
+			return
+		}
+		photos, err := strava.NewActivitiesService(strava.NewClient(token, stravaHTTPClient)).ListPhotos(options.TrackId).Size(uint(options.StravaPhotoSize)).Do()
+		if err != nil {
+			lg.Error("makeVideo ListPhotos", "err", err)
+			fail = &FailInfo{Kind: FailStrava, Reason: "从Strava取照片列表出错:" + err.Error()}
 			return
 		}
 
 		config_fp, err := os.OpenFile(config_dir, os.O_WRONLY|os.O_APPEND, 0600)
 		if err != nil {
-			log.Println("makeVideo os.OpenFile:", photos_dir, err)
+			lg.Error("makeVideo os.OpenFile", "file", config_dir, "err", err)
 			return
 		}
 
 		for i := range photos {
+			jobs.SetProgress(uid, Progress{Stage: StagePhotos, Percent: i * 100 / len(photos)})
 			url := photos[i].Urls[fmt.Sprintf("%d", options.StravaPhotoSize)]
-			res, err := http.Get(url)
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				lg.Error("makeVideo http.NewRequestWithContext", "url", url, "err", err)
+				return
+			}
+			res, err := http.DefaultClient.Do(req)
 			if err != nil {
-				log.Println("makeVideo http.Get:", photos_dir, err)
+				lg.Error("makeVideo http.Get", "url", url, "err", err)
+				return
+			}
+			if res.StatusCode != http.StatusOK {
+				res.Body.Close()
+				lg.Error("makeVideo http.Get", "url", url, "status", res.Status)
+				fail.Reason += ":" + res.Status
 				return
 			}
 			photo := fmt.Sprintf("%d.jpg", i)
 			f, err := os.Create(filepath.Join(photos_dir, photo))
 			if err != nil {
-				log.Println("makeVideo os.Create:", photos_dir, err)
+				res.Body.Close()
+				lg.Error("makeVideo os.Create", "dir", photos_dir, "err", err)
 				return
 			}
-			if _, err := io.Copy(f, res.Body); err != nil {
-				log.Println("makeVideo io.Copy:", photos_dir, err)
+			_, err = io.Copy(f, res.Body)
+			res.Body.Close()
+			f.Close()
+			if err != nil {
+				lg.Error("makeVideo io.Copy", "dir", photos_dir, "err", err)
 				return
 			}
-			f.Close()
 
 			_, err = fmt.Fprintf(config_fp, "\n[%s]\ncreated_at=%s\n", photo, photos[i].CreatedAt.Format(stravaphotos_layout))
 			if err != nil {
-				log.Println("makeVideo fmt.Fprintln", photos_dir, err)
+				lg.Error("makeVideo fmt.Fprintln", "file", config_dir, "err", err)
 				return
 			}
 		}
 
 		config_fp.Close()
+		fail = &FailInfo{Kind: FailSystem, Reason: failKindInfo[FailSystem]}
 	}
 
-	reason = "GPS2Video程序执行出错"
-	cmd := exec.Command("python", serverConf.GPS2VideoDir, config_dir)
-	out, err := cmd.CombinedOutput()
-	out_string := string(out)
+	log_name := filepath.Join(video_dir, "log.txt")
+	artifact, err := renderer.Run(ctx, job, func(p Progress) {
+		jobs.SetProgress(uid, p)
+	})
 	if err != nil {
-		log.Println("makeVideo", "cmd.CombinedOutput", output_dir, err, out_string)
+		lg.Error("makeVideo renderer.Run", "log", log_name, "err", err)
+		fail = renderFailInfo(err)
 		return
 	}
 
-	if strings.Contains(out_string, "视频生成成功") {
-		err := os.Rename(filepath.Join(output_dir, "v.mp4"),
-			filepath.Join(output_dir, "..", "v.mp4"))
-		if err != nil {
-			log.Println("makeVideo", "os.Rename", output_dir, err)
-		}
-		status = UserNormal
-		reason = ""
-	} else {
-		log.Println("makeVideo", out_string)
+	err = os.Rename(artifact, filepath.Join(video_dir, "v.mp4"))
+	if err != nil {
+		lg.Error("makeVideo os.Rename", "file", artifact, "err", err)
+		return
 	}
+	status = UserNormal
+	fail = nil
+	return
 }
 
-func sendMail(uid uint64, token string, status int, reason string) {
+//The email of the local account or the Strava athlete uid
+func sendMailAddress(uid uint64) (to string, err error) {
+	if to, err = users.GetEmail(uid); err != nil || to != "" {
+		return
+	}
+
+	token, err := users.GetToken(uid)
+	if err != nil {
+		return
+	}
+	athlete, err := strava.NewCurrentAthleteService(strava.NewClient(token, stravaHTTPClient)).Get().Do()
+	if err != nil {
+		return
+	}
+	to = athlete.Email
+	return
+}
+
+func sendMail(uid uint64, vid uint64, status int, fail *FailInfo) {
 	if serverConf.SmtpServer == "" {
 		return
 	}
+	outcome := "fail"
+	defer func() {
+		metricEmails.WithLabelValues(outcome).Inc()
+	}()
 
-	//Get athlete.Email
-	athlete, err := strava.NewCurrentAthleteService(strava.NewClient(token)).Get().Do()
+	to, err := sendMailAddress(uid)
 	if err != nil {
-		log.Println("sendMail", "strava.NewCurrentAthleteService(strava.NewClient(token)).Get().Do()", uid, err)
+		slog.Error("sendMail sendMailAddress", "uid", uid, "job", vid, "err", err)
 		return
 	}
 
 	var m *email.Message
 	if status == UserMakeVideoFail {
-		m = email.NewMessage("视频生成失败", "失败原因:"+reason)
+		m = email.NewMessage("视频生成失败", "失败原因:"+failKindInfo[fail.Kind]+"\n"+fail.Reason)
 	} else {
 		m = email.NewMessage("视频生成成功", "可从附件中取得视频")
 	}
 	m.From = mail.Address{Name: "GPS2Video", Address: serverConf.SmtpEmail}
-	m.To = []string{athlete.Email}
+	m.To = []string{to}
 	if status == UserNormal {
-		if err := m.Attach(filepath.Join(users.dir, fmt.Sprintf("%d", uid), "v.mp4")); err != nil {
-			log.Println("sendMail", "m.Attach", uid, err)
+		if err := m.Attach(filepath.Join(users.VideoDir(uid, vid), "v.mp4")); err != nil {
+			slog.Error("sendMail m.Attach", "uid", uid, "job", vid, "err", err)
 			return
 		}
 	}
@@ -784,7 +1131,8 @@ func sendMail(uid uint64, token string, status int, reason string) {
 	auth := smtp.PlainAuth("", serverConf.SmtpEmail, serverConf.SmtpPassword, serverConf.SmtpServer)
 
 	if err := email.Send(fmt.Sprintf("%s:%d", serverConf.SmtpServer, serverConf.SmtpPort), auth, m); err != nil {
-		log.Println("sendMail", "email.Send", uid, err)
+		slog.Error("sendMail email.Send", "uid", uid, "job", vid, "err", err)
 		return
 	}
+	outcome = "sent"
 }
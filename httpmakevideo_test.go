@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+//The values allowed by the schema of the form are accepted by Form2Config
+func TestPhotosTimezoneOption(t *testing.T) {
+	option := &PhotosTimezoneOption{Float64Option{BaseOption{configName: "photos_timezone"}}}
+	schema := option.GetSchema()
+	tests := []struct {
+		num  float64
+		want string
+		err  bool
+	}{
+		{*schema.Minimum, "photos_timezone=-12\n", false},
+		{*schema.Maximum, "photos_timezone=13.500000\n", false},
+		{*schema.Minimum + schema.MultipleOf, "photos_timezone=-11.500000\n", false},
+		{-3.5, "photos_timezone=-3.500000\n", false},
+		{-0.5, "photos_timezone=-0.500000\n", false},
+		{0, "photos_timezone=0\n", false},
+		{8, "photos_timezone=8\n", false},
+		{5.5, "photos_timezone=5.500000\n", false},
+		{*schema.Minimum - schema.MultipleOf, "", true},
+		{*schema.Maximum + schema.MultipleOf, "", true},
+		{5.25, "", true},
+		{-3.75, "", true},
+	}
+	for _, test := range tests {
+		form := []string{strconv.FormatFloat(test.num, 'f', -1, 64)}
+		config, err := option.Form2Config(form, 1)
+		if (err != nil) != test.err || config != test.want {
+			t.Errorf("Form2Config(%v) = %q, %v, want %q, error %v", form, config, err, test.want, test.err)
+		}
+	}
+	if _, err := option.Form2Config([]string{"abc"}, 1); err == nil {
+		t.Error("Form2Config(abc), want an error")
+	}
+}
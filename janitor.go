@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//Remove the old videos, the old files in output/, the inactive users and
+//the local accounts that are not verified in time every JanitorInterval
+//seconds.  The old users that are not migrated are tried again too.
+func janitorStart() {
+	if serverConf.JanitorInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			janitor()
+			time.Sleep(time.Duration(serverConf.JanitorInterval) * time.Second)
+		}
+	}()
+}
+
+func janitorDays(days int) time.Time {
+	return time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+}
+
+func janitor() {
+	users.MigrateAthletes()
+
+	for _, info := range users.List() {
+		busy := info.Status == UserMakingVideo || info.Status == UserWaitingVideo || jobs.Busy(info.Uid)
+
+		//Don't let them keep the username and the email forever
+		if info.Username != "" && !info.EmailVerified && time.Now().After(info.VerifyExpires) {
+			slog.Info("janitor remove unverified local account", "uid", info.Uid, "username", info.Username)
+			if err := users.Delete(info.Uid); err != nil {
+				slog.Error("janitor users.Delete", "uid", info.Uid, "err", err)
+			}
+			continue
+		}
+
+		if serverConf.UserMaxIdleDays > 0 && !busy && info.LastActive.Before(janitorDays(serverConf.UserMaxIdleDays)) {
+			slog.Info("janitor remove inactive user", "uid", info.Uid, "last_active", info.LastActive)
+			if err := users.Delete(info.Uid); err != nil {
+				slog.Error("janitor users.Delete", "uid", info.Uid, "err", err)
+			}
+			continue
+		}
+
+		if serverConf.VideoMaxAgeDays > 0 {
+			before := janitorDays(serverConf.VideoMaxAgeDays)
+			for _, video := range info.Videos {
+				if video.Status == VideoWaiting || video.Status == VideoMaking || !video.CreatedAt.Before(before) {
+					continue
+				}
+				slog.Info("janitor remove video", "uid", info.Uid, "job", video.Id)
+				if err := users.DelVideo(info.Uid, video.Id); err != nil {
+					slog.Error("janitor users.DelVideo", "uid", info.Uid, "job", video.Id, "err", err)
+				}
+			}
+		}
+
+		if serverConf.OutputMaxAgeDays > 0 && !busy {
+			janitorOutput(info.Uid, janitorDays(serverConf.OutputMaxAgeDays))
+		}
+	}
+}
+
+//Remove the files in output/ of uid that are not changed after before
+func janitorOutput(uid uint64, before time.Time) {
+	output_dir := filepath.Join(users.UserDir(uid), "output")
+	err := filepath.Walk(output_dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if f.Mode().IsRegular() && f.ModTime().Before(before) {
+			if err = os.Remove(path); err != nil {
+				slog.Error("janitorOutput os.Remove", "uid", uid, "err", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("janitorOutput filepath.Walk", "uid", uid, "err", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Setup the default slog logger with serverConf.LogLevel and
+//serverConf.LogFormat.  The log is written to file if it is not empty,
+//otherwise to stderr.  The package log is written to it too.
+func logInit(file string) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(serverConf.LogLevel)); err != nil {
+		fatal("LogLevel is not right", "level", serverConf.LogLevel, "err", err)
+	}
+
+	var w io.Writer = os.Stderr
+	if file != "" {
+		rw, err := newRotateWriter(file, int64(serverConf.LogMaxSizeMB)*1024*1024, serverConf.LogMaxFiles)
+		if err != nil {
+			fatal("open log file", "file", file, "err", err)
+		}
+		w = rw
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(serverConf.LogFormat) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text", "logfmt":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		fatal("LogFormat is not supported", "format", serverConf.LogFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+//Log the error and exit
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+//The logger of the job that makes video vid of uid
+func jobLogger(uid uint64, options *MakeVideoOptions) *slog.Logger {
+	return slog.With("uid", uid, "job", options.VideoId, "activity", options.TrackId)
+}
+
+type logHandlerKey struct{}
+
+//The logger of the HTTP handler that handles r, uid is 0 if it is not
+//known
+func httpLogger(r *http.Request, uid uint64) *slog.Logger {
+	lg := slog.Default()
+	if name, ok := r.Context().Value(logHandlerKey{}).(string); ok {
+		lg = lg.With("handler", name)
+	}
+	if uid != 0 {
+		lg = lg.With("uid", uid)
+	}
+	return lg
+}
+
+//Set the handler name that is used by httpLogger
+func withLogHandler(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), logHandlerKey{}, name))
+}
+
+//rotateWriter writes to file.  When the size of file is bigger than
+//maxSize, file is renamed to file.1, file.1 to file.2 and so on, and only
+//maxFiles old files are kept.
+type rotateWriter struct {
+	lock sync.Mutex
+
+	file     string
+	maxSize  int64 //0 means no rotation
+	maxFiles int
+
+	fd      *os.File
+	size    int64
+	retryAt time.Time //Don't rotate before it after a rotation failed
+}
+
+//The time to wait before retrying a failed rotation
+const rotateRetryDelay = time.Minute
+
+func newRotateWriter(file string, maxSize int64, maxFiles int) (w *rotateWriter, err error) {
+	w = &rotateWriter{file: file, maxSize: maxSize, maxFiles: maxFiles}
+	if w.fd, w.size, err = w.open(); err != nil {
+		w = nil
+	}
+	return
+}
+
+func (w *rotateWriter) open() (fd *os.File, size int64, err error) {
+	fd, err = os.OpenFile(w.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		fd = nil
+		return
+	}
+	size = fi.Size()
+	return
+}
+
+//w.fd is only replaced when the new file is opened, then the log is still
+//written to the old file if the rotation fails.
+//Must hold w.lock
+func (w *rotateWriter) rotate() (err error) {
+	if w.maxFiles <= 0 {
+		if err = w.fd.Truncate(0); err != nil {
+			return
+		}
+		w.size = 0
+		return
+	}
+
+	for i := w.maxFiles; i > 0; i-- {
+		src := w.file
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", w.file, i-1)
+		}
+		if err = os.Rename(src, fmt.Sprintf("%s.%d", w.file, i)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	fd, size, err := w.open()
+	if err != nil {
+		return
+	}
+	w.fd.Close()
+	w.fd = fd
+	w.size = size
+	return
+}
+
+func (w *rotateWriter) Write(p []byte) (n int, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0 && time.Now().After(w.retryAt) {
+		if rotate_err := w.rotate(); rotate_err != nil {
+			fmt.Fprintln(os.Stderr, "rotate log file:", rotate_err)
+			//Don't shift the old files on every write
+			w.retryAt = time.Now().Add(rotateRetryDelay)
+		}
+	}
+	n, err = w.fd.Write(p)
+	w.size += int64(n)
+	return
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateWriter(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "log")
+	w, err := newRotateWriter(file, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.fd.Close()
+
+	write := func(s string) {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("Write %q: %v", s, err)
+		}
+	}
+	check := func(name string, want string) {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", filepath.Base(name), data, err, want)
+		}
+	}
+
+	write("12345678\n")
+	write("abcdefgh\n")
+	check(file, "abcdefgh\n")
+	check(file+".1", "12345678\n")
+
+	//file.1 cannot be replaced, the log is still written to the current file
+	os.Remove(file + ".1")
+	os.MkdirAll(filepath.Join(file+".1", "dir"), 0700)
+	write("ABCDEFGH\n")
+	write("!@#$%^&*\n")
+	check(file, "abcdefgh\nABCDEFGH\n!@#$%^&*\n")
+	if w.retryAt.IsZero() {
+		t.Error("retryAt is not set after the rotation failed")
+	}
+}
+
+func TestRotateWriterNoOldFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "log")
+	w, err := newRotateWriter(file, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.fd.Close()
+
+	w.Write([]byte("12345678\n"))
+	w.Write([]byte("abcdefgh\n"))
+	if data, err := os.ReadFile(file); err != nil || string(data) != "abcdefgh\n" {
+		t.Errorf("log = %q, %v", data, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const web_metrics = "metrics"
+
+var (
+	metricRenders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gps2video_renders_total",
+		Help: "Number of finished renders by outcome.",
+	}, []string{"outcome"})
+	metricRenderFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gps2video_render_failures_total",
+		Help: "Number of failed renders by the kind of failure.",
+	}, []string{"kind"})
+	metricRenderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gps2video_render_duration_seconds",
+		Help:    "Time used by renders by outcome.",
+		Buckets: prometheus.ExponentialBuckets(30, 2, 10),
+	}, []string{"outcome"})
+	metricStravaRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gps2video_strava_requests_total",
+		Help: "Number of Strava API requests by call and HTTP status code.",
+	}, []string{"call", "code"})
+	metricStravaDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gps2video_strava_request_duration_seconds",
+		Help:    "Latency of Strava API requests by call.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"call"})
+	metricPhotoUploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gps2video_photo_upload_bytes_total",
+		Help: "Bytes of the uploaded photos.",
+	})
+	metricEmails = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gps2video_emails_total",
+		Help: "Number of emails by outcome.",
+	}, []string{"outcome"})
+	metricHttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gps2video_http_requests_total",
+		Help: "Number of HTTP requests by handler and status code.",
+	}, []string{"handler", "code"})
+)
+
+func metricsInit() {
+	prometheus.MustRegister(metricRenders, metricRenderFailures, metricRenderDuration,
+		metricStravaRequests, metricStravaDuration, metricPhotoUploadBytes,
+		metricEmails, metricHttpRequests)
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gps2video_queue_waiting",
+		Help: "Number of jobs that are waiting in the queue.",
+	}, func() float64 {
+		waiting, _ := jobs.Len()
+		return float64(waiting)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gps2video_queue_running",
+		Help: "Number of jobs that are running.",
+	}, func() float64 {
+		_, running := jobs.Len()
+		return float64(running)
+	}))
+	prometheus.MustRegister(&userStatusCollector{
+		desc: prometheus.NewDesc("gps2video_users", "Number of users by status.", []string{"status"}, nil),
+	})
+
+	//The same users as the admin pages can access it, Prometheus can use
+	//AdminPassword with basic_auth
+	handler := promhttp.Handler()
+	http.HandleFunc(serverConf.DomainDir+web_metrics, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := adminCheck(w, r); !ok {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+var userStatusName = []string{"normal", "making", "fail", "waiting", "cancel"}
+
+//Count the users when it is scraped
+type userStatusCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c *userStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *userStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	for status, num := range users.StatusCount() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(num), userStatusName[status])
+	}
+}
+
+//Called when makeVideo is done
+func metricsRender(status int, fail *FailInfo, used time.Duration) {
+	outcome := userStatusName[status]
+	switch status {
+	case UserNormal:
+		outcome = "success"
+	case UserMakeVideoFail:
+		metricRenderFailures.WithLabelValues(fail.Kind).Inc()
+	}
+	metricRenders.WithLabelValues(outcome).Inc()
+	metricRenderDuration.WithLabelValues(outcome).Observe(used.Seconds())
+}
+
+//Count the requests to Strava API.  The numbers in the path are
+//replaced with ":id" to get the call.
+type stravaTransport struct{}
+
+func (t stravaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v3"), "/"), "/")
+	for i, part := range parts {
+		if _, err := strconv.ParseInt(part, 10, 64); err == nil {
+			parts[i] = ":id"
+		}
+	}
+	call := strings.Join(parts, "/")
+
+	start := time.Now()
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	metricStravaDuration.WithLabelValues(call).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metricStravaRequests.WithLabelValues(call, code).Inc()
+	return resp, err
+}
+
+var stravaHTTPClient = &http.Client{Timeout: 30 * time.Second, Transport: stravaTransport{}}
+
+//Get the status code for metricHttpRequests
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *metricsResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+//eventsHandler needs it
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//http.HandleFunc that counts the requests of handler name
+func httpHandleFunc(pattern string, name string, handler func(http.ResponseWriter, *http.Request)) {
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		mw := &metricsResponseWriter{ResponseWriter: w}
+		handler(mw, withLogHandler(r, name))
+		if mw.code == 0 {
+			mw.code = http.StatusOK
+		}
+		metricHttpRequests.WithLabelValues(name, strconv.Itoa(mw.code)).Inc()
+	})
+}
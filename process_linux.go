@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+//Run cmd in a new process group.  When the cmd is cancelled, the whole
+//group is killed, so the children of gps2video (ffmpeg) are killed too.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+//Kill the children that are still running after cmd exited
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+//Return the command that runs name with args under the limits of
+//serverConf.  The limits are set by sh before it execs name, so name and
+//its children (ffmpeg) are limited from the start.  Each process has its
+//own CPU time and address space.
+func processLimitCommand(name string, args []string) (string, []string) {
+	script := ""
+	if serverConf.MakeVideoCpuSecs > 0 {
+		script += fmt.Sprintf("ulimit -t %d && ", serverConf.MakeVideoCpuSecs)
+	}
+	if serverConf.MakeVideoMemMB > 0 {
+		//ulimit -v is in KB
+		script += fmt.Sprintf("ulimit -v %d && ", serverConf.MakeVideoMemMB*1024)
+	}
+	if serverConf.MakeVideoNice != 0 {
+		script += fmt.Sprintf("exec nice -n %d \"$@\"", serverConf.MakeVideoNice)
+	} else if script != "" {
+		script += `exec "$@"`
+	} else {
+		return name, args
+	}
+	return "sh", append([]string{"-c", script, "gps2video", name}, args...)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"os/exec"
+)
+
+//Process groups are only supported on Linux.  Just kill the process.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+}
+
+//The limits are only supported on Linux.
+func processLimitCommand(name string, args []string) (string, []string) {
+	return name, args
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	StageStart    = "start"
+	StagePhotos   = "photos"
+	StageMapTiles = "maptiles"
+	StageFrames   = "frames"
+	StageFfmpeg   = "ffmpeg"
+)
+
+var progressStageInfo = map[string]string{
+	StageStart:    "准备中",
+	StagePhotos:   "下载照片",
+	StageMapTiles: "下载地图",
+	StageFrames:   "生成视频帧",
+	StageFfmpeg:   "合成视频",
+}
+
+type Progress struct {
+	Stage   string
+	Percent int //-1 means unknown
+}
+
+//The output of gps2video and ffmpeg is matched with these keywords to
+//get the stage.  The order is the order of the stages.
+var progressStageKeywords = []struct {
+	stage    string
+	keywords []string
+}{
+	{StagePhotos, []string{"照片", "photo"}},
+	{StageMapTiles, []string{"地图", "map", "tile"}},
+	{StageFrames, []string{"帧", "frame"}},
+	{StageFfmpeg, []string{"ffmpeg", "合成", "mux", "encod"}},
+}
+
+var progressPercentRegexp = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*%`)
+var progressCountRegexp = regexp.MustCompile(`(\d+)\s*/\s*(\d+)`)
+
+func progressStageIndex(stage string) int {
+	for i, s := range progressStageKeywords {
+		if s.stage == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+//Get the progress from a line of the output.  The stage never goes back,
+//so a later line that talks about an earlier stage is ignored.
+func parseProgress(line string, cur Progress) (p Progress, changed bool) {
+	p = cur
+	lower := strings.ToLower(line)
+
+	cur_index := progressStageIndex(cur.Stage)
+	line_index := -1
+	for i, s := range progressStageKeywords {
+		for _, keyword := range s.keywords {
+			if strings.Contains(lower, keyword) {
+				line_index = i
+				break
+			}
+		}
+	}
+	if line_index > cur_index {
+		p.Stage = progressStageKeywords[line_index].stage
+		p.Percent = -1
+	} else if line_index >= 0 && line_index < cur_index {
+		//The percent is about the earlier stage
+		return
+	}
+
+	if m := progressPercentRegexp.FindStringSubmatch(line); m != nil {
+		if f, err := strconv.ParseFloat(m[1], 64); err == nil && f <= 100 {
+			p.Percent = int(f)
+		}
+	} else if m := progressCountRegexp.FindStringSubmatch(line); m != nil {
+		done, err1 := strconv.Atoi(m[1])
+		total, err2 := strconv.Atoi(m[2])
+		if err1 == nil && err2 == nil && total > 0 && done <= total {
+			p.Percent = done * 100 / total
+		}
+	}
+
+	changed = p != cur
+	return
+}
+
+//bufio.SplitFunc that splits the output to lines by '\n' or '\r'.
+//ffmpeg uses '\r' to update its status line.
+func scanOutputLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[0:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	start := Progress{Stage: StageStart, Percent: -1}
+	tests := []struct {
+		name    string
+		line    string
+		cur     Progress
+		want    Progress
+		changed bool
+	}{
+		{"nothing", "hello", start, start, false},
+		{"stage", "下载照片", start, Progress{StagePhotos, -1}, true},
+		{"stage case", "Downloading Map tiles", start, Progress{StageMapTiles, -1}, true},
+		{"stage and percent", "map tiles 35%", start, Progress{StageMapTiles, 35}, true},
+		{"percent", "42.7 %", Progress{StageFrames, 10}, Progress{StageFrames, 42}, true},
+		{"count", "frame 30/120", Progress{StageFrames, -1}, Progress{StageFrames, 25}, true},
+		{"count done", "120/120", Progress{StageFrames, 99}, Progress{StageFrames, 100}, true},
+		{"count bigger than total", "121/120", Progress{StageFrames, 5}, Progress{StageFrames, 5}, false},
+		{"count zero total", "0/0", Progress{StageFrames, 5}, Progress{StageFrames, 5}, false},
+		{"percent bigger than 100", "200%", Progress{StageFrames, 5}, Progress{StageFrames, 5}, false},
+		{"percent first", "50% 1/4", Progress{StageFrames, -1}, Progress{StageFrames, 50}, true},
+		{"new stage resets percent", "ffmpeg", Progress{StageFrames, 80}, Progress{StageFfmpeg, -1}, true},
+		{"stage doesn't go back", "photo 10%", Progress{StageFfmpeg, 50}, Progress{StageFfmpeg, 50}, false},
+		{"current stage with an earlier one", "ffmpeg frame 10%", Progress{StageFfmpeg, 50}, Progress{StageFfmpeg, 10}, true},
+		{"same stage keeps percent", "map", Progress{StageMapTiles, 60}, Progress{StageMapTiles, 60}, false},
+		{"latest stage of the line", "合成 frame", start, Progress{StageFfmpeg, -1}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, changed := parseProgress(test.line, test.cur)
+			if got != test.want || changed != test.changed {
+				t.Errorf("parseProgress(%q, %+v) = %+v, %v, want %+v, %v",
+					test.line, test.cur, got, changed, test.want, test.changed)
+			}
+		})
+	}
+}
+
+func TestScanOutputLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"newline", "a\nb\n", []string{"a", "b"}},
+		{"carriage return", "frame=1\rframe=2\rframe=3\n", []string{"frame=1", "frame=2", "frame=3"}},
+		{"crlf", "a\r\nb", []string{"a", "", "b"}},
+		{"partial last line", "a\nb", []string{"a", "b"}},
+		{"only partial line", "abc", []string{"abc"}},
+		{"empty lines", "\n\n", []string{"", ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			scanner := bufio.NewScanner(strings.NewReader(test.input))
+			scanner.Split(scanOutputLines)
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+//The partial line must wait for more data if it is not the end
+func TestScanOutputLinesPartial(t *testing.T) {
+	advance, token, err := scanOutputLines([]byte("frame=1"), false)
+	if advance != 0 || token != nil || err != nil {
+		t.Errorf("got %d, %q, %v, want to request more data", advance, token, err)
+	}
+	advance, token, err = scanOutputLines([]byte("frame=1\rfra"), false)
+	if advance != 8 || string(token) != "frame=1" || err != nil {
+		t.Errorf("got %d, %q, %v, want 8, \"frame=1\"", advance, token, err)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Job struct {
+	Uid      uint64
+	Moptions MakeVideoOptions
+
+	cancel   context.CancelCauseFunc
+	progress Progress
+}
+
+//Jobs wait in the queue in FIFO order until one of the workers is free.
+//The waiting jobs are saved to WorkDir/queue.gob after every change.
+type JobQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	waiting []*Job
+
+	running map[uint64]*Job
+
+	file string
+
+	//Don't start new jobs when it is true
+	stopping bool
+}
+
+//The cause of the cancel of the jobs that are killed by shutdown
+var errShutdown = errors.New("server shutdown")
+
+var jobs JobQueue
+
+func (q *JobQueue) Init(dir string) {
+	q.cond = sync.NewCond(&q.lock)
+	q.running = make(map[uint64]*Job)
+	q.file = filepath.Join(dir, "queue.gob")
+
+	fd, err := os.Open(q.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("JobQueue Init os.Open", "file", q.file, "err", err)
+		}
+		return
+	}
+	defer fd.Close()
+	dec := gob.NewDecoder(fd)
+	if err = dec.Decode(&q.waiting); err != nil {
+		slog.Error("JobQueue Init dec.Decode", "file", q.file, "err", err)
+		q.waiting = nil
+	}
+}
+
+//Start the workers.  Must be called after users.Init.
+func (q *JobQueue) Start(workers int) {
+	q.lock.Lock()
+	waiting := make([]*Job, 0, len(q.waiting))
+	for _, job := range q.waiting {
+		if !users.JobWaiting(job.Uid, job.Moptions.VideoId) {
+			slog.Warn("JobQueue Start drop job", "uid", job.Uid, "job", job.Moptions.VideoId)
+			continue
+		}
+		waiting = append(waiting, job)
+	}
+	q.waiting = waiting
+	if err := q.save(); err != nil {
+		slog.Error("JobQueue Start q.save", "err", err)
+	}
+	q.lock.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+}
+
+//Must hold q.lock
+func (q *JobQueue) save() error {
+	return writeFileAtomic(q.file, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(q.waiting)
+	})
+}
+
+//Must hold q.lock
+func (q *JobQueue) find(uid uint64) int {
+	for i, job := range q.waiting {
+		if job.Uid == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *JobQueue) Add(uid uint64, options *MakeVideoOptions) (err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.stopping {
+		err = errors.New("服务器正在重启，请稍后再试")
+		return
+	}
+	if _, ok := q.running[uid]; ok || q.find(uid) >= 0 {
+		err = errors.New("已经有一个视频在队列中")
+		return
+	}
+
+	q.waiting = append(q.waiting, &Job{Uid: uid, Moptions: *options})
+	if err = q.save(); err != nil {
+		q.waiting = q.waiting[:len(q.waiting)-1]
+		return
+	}
+	q.cond.Signal()
+
+	return
+}
+
+//Put back a job that was interrupted by a restart.
+//If front is true, it will be handled before the other waiting jobs.
+func (q *JobQueue) Restore(uid uint64, options *MakeVideoOptions, front bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if i := q.find(uid); i >= 0 {
+		if q.waiting[i].Moptions.VideoId == options.VideoId {
+			return
+		}
+		//A stale job in queue.gob
+		slog.Warn("JobQueue Restore drop job", "uid", uid, "job", q.waiting[i].Moptions.VideoId)
+		q.waiting = append(q.waiting[:i:i], q.waiting[i+1:]...)
+	}
+
+	job := &Job{Uid: uid, Moptions: *options}
+	if front {
+		q.waiting = append([]*Job{job}, q.waiting...)
+	} else {
+		q.waiting = append(q.waiting, job)
+	}
+	if err := q.save(); err != nil {
+		slog.Error("JobQueue Restore q.save", "uid", uid, "job", options.VideoId, "err", err)
+	}
+}
+
+//Position of the job of uid in the queue, begin from 1.
+func (q *JobQueue) Position(uid uint64) (pos int, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	i := q.find(uid)
+	if i < 0 {
+		return
+	}
+	return i + 1, true
+}
+
+func (q *JobQueue) SetProgress(uid uint64, progress Progress) {
+	q.lock.Lock()
+	job, ok := q.running[uid]
+	if ok {
+		job.progress = progress
+	}
+	q.lock.Unlock()
+
+	if ok {
+		events.PublishStatus(uid, UserMakingVideo)
+	}
+}
+
+//Tell the waiting users their new positions.
+//Must not hold q.lock.
+func (q *JobQueue) publishPositions() {
+	q.lock.Lock()
+	uids := make([]uint64, 0, len(q.waiting))
+	for _, job := range q.waiting {
+		uids = append(uids, job.Uid)
+	}
+	q.lock.Unlock()
+
+	for _, uid := range uids {
+		events.PublishStatus(uid, UserWaitingVideo)
+	}
+}
+
+//Stop starting the waiting jobs.  They are kept in queue.gob and will be
+//started after restart.
+func (q *JobQueue) Stop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.stopping = true
+	q.cond.Broadcast()
+}
+
+//Wait until all the running jobs are done.  Return false if timeout.
+func (q *JobQueue) WaitRunning(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, running := q.Len(); running == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+//Kill all the running jobs.  They are put back to the head of the queue
+//and made again after restart.
+func (q *JobQueue) Interrupt() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, job := range q.running {
+		slog.Warn("JobQueue Interrupt", "uid", job.Uid, "job", job.Moptions.VideoId)
+		job.cancel(errShutdown)
+	}
+}
+
+//Number of the waiting jobs and the running jobs
+func (q *JobQueue) Len() (waiting int, running int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.waiting), len(q.running)
+}
+
+//Return true if the job of uid is waiting or running
+func (q *JobQueue) Busy(uid uint64) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	_, ok := q.running[uid]
+	return ok || q.find(uid) >= 0
+}
+
+//Get the progress of the running job of uid.
+func (q *JobQueue) GetProgress(uid uint64) (progress Progress, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	job, ok := q.running[uid]
+	if !ok {
+		return
+	}
+	progress = job.progress
+	return
+}
+
+//Cancel the job of uid.  If it is running, the process of it will be
+//killed and makeVideo will set the status.
+func (q *JobQueue) Cancel(uid uint64) (err error) {
+	q.lock.Lock()
+	if job, ok := q.running[uid]; ok {
+		job.cancel(nil)
+		q.lock.Unlock()
+		return
+	}
+	var removed *Job
+	if i := q.find(uid); i >= 0 {
+		old_waiting := q.waiting
+		removed = q.waiting[i]
+		q.waiting = append(append([]*Job{}, q.waiting[:i]...), q.waiting[i+1:]...)
+		if err = q.save(); err != nil {
+			q.waiting = old_waiting
+			q.lock.Unlock()
+			return
+		}
+	}
+	q.lock.Unlock()
+	q.publishPositions()
+
+	if removed != nil {
+		err = users.SetJobStatus(uid, removed.Moptions.VideoId, UserMakeVideoCancel, nil)
+		return
+	}
+
+	status, err := users.GetUserStatus(uid)
+	if err != nil {
+		return
+	}
+	if status != UserWaitingVideo && status != UserMakingVideo {
+		err = errors.New("没有正在生成的视频")
+		return
+	}
+	err = users.SetUserStatus(uid, UserMakeVideoCancel, nil, nil)
+	return
+}
+
+func (q *JobQueue) worker() {
+	for {
+		q.lock.Lock()
+		for len(q.waiting) == 0 && !q.stopping {
+			q.cond.Wait()
+		}
+		if q.stopping {
+			q.lock.Unlock()
+			return
+		}
+		job := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		ctx, cancel := context.WithCancelCause(context.Background())
+		job.cancel = cancel
+		job.progress = Progress{Stage: StageStart, Percent: -1}
+		q.running[job.Uid] = job
+		if err := q.save(); err != nil {
+			slog.Error("JobQueue worker q.save", "uid", job.Uid, "job", job.Moptions.VideoId, "err", err)
+		}
+		q.lock.Unlock()
+		q.publishPositions()
+
+		//The job is dropped if uid doesn't wait for it anymore
+		interrupted := false
+		err := users.SetJobStatus(job.Uid, job.Moptions.VideoId, UserMakingVideo, nil)
+		if err != nil {
+			slog.Error("JobQueue worker users.SetJobStatus", "uid", job.Uid, "job", job.Moptions.VideoId, "err", err)
+		} else {
+			interrupted = makeVideo(ctx, job.Uid, &job.Moptions)
+		}
+		cancel(nil)
+
+		q.lock.Lock()
+		delete(q.running, job.Uid)
+		if interrupted {
+			//Keep it in queue.gob then it is the first one after restart
+			job.cancel = nil
+			q.waiting = append([]*Job{job}, q.waiting...)
+			if err := q.save(); err != nil {
+				slog.Error("JobQueue worker q.save", "uid", job.Uid, "job", job.Moptions.VideoId, "err", err)
+			}
+		}
+		q.lock.Unlock()
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+//Init users and a JobQueue in a temporary directory
+func testJobQueue(t *testing.T) (q *JobQueue, dir string) {
+	serverConf = &Server{UserStore: "gob"}
+	dir = t.TempDir()
+	users = UserMap{}
+	users.Init(dir)
+	t.Cleanup(users.Close)
+	q = new(JobQueue)
+	q.Init(dir)
+	return
+}
+
+//Add a user that is waiting for a new video, return uid and vid
+func testWaitingUser(t *testing.T, athleteId int64) (uid uint64, vid uint64) {
+	uid, err := users.FindAdd(&StravaToken{AccessToken: fmt.Sprintf("token%d", athleteId), AthleteId: athleteId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vid, err = users.AddVideo(uid, athleteId, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = users.StartJob(uid, &MakeVideoOptions{TrackId: athleteId, VideoId: vid}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func testVideoStatus(uid uint64, vid uint64) int {
+	for _, video := range users.GetVideos(uid) {
+		if video.Id == vid {
+			return video.Status
+		}
+	}
+	return -1
+}
+
+func testQueueUids(q *JobQueue) (uids []uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, job := range q.waiting {
+		uids = append(uids, job.Uid)
+	}
+	return
+}
+
+func testSameUids(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJobQueueOrder(t *testing.T) {
+	q, dir := testJobQueue(t)
+	var uids [5]uint64
+	var vids [5]uint64
+	for i := 1; i < len(uids); i++ {
+		uids[i], vids[i] = testWaitingUser(t, int64(i))
+	}
+
+	tests := []struct {
+		name string
+		op   func() error
+		err  bool
+		want []uint64
+	}{
+		{"add", func() error { return q.Add(uids[1], &MakeVideoOptions{VideoId: vids[1]}) }, false, []uint64{uids[1]}},
+		{"add second", func() error { return q.Add(uids[2], &MakeVideoOptions{VideoId: vids[2]}) }, false, []uint64{uids[1], uids[2]}},
+		{"add same uid", func() error { return q.Add(uids[1], &MakeVideoOptions{VideoId: vids[1]}) }, true, []uint64{uids[1], uids[2]}},
+		{"restore to the end", func() error {
+			q.Restore(uids[3], &MakeVideoOptions{VideoId: vids[3]}, false)
+			return nil
+		}, false, []uint64{uids[1], uids[2], uids[3]}},
+		{"restore to the front", func() error {
+			q.Restore(uids[4], &MakeVideoOptions{VideoId: vids[4]}, true)
+			return nil
+		}, false, []uint64{uids[4], uids[1], uids[2], uids[3]}},
+		{"restore the same job", func() error {
+			q.Restore(uids[2], &MakeVideoOptions{VideoId: vids[2]}, true)
+			return nil
+		}, false, []uint64{uids[4], uids[1], uids[2], uids[3]}},
+		{"cancel waiting", func() error { return q.Cancel(uids[1]) }, false, []uint64{uids[4], uids[2], uids[3]}},
+		{"cancel again", func() error { return q.Cancel(uids[1]) }, true, []uint64{uids[4], uids[2], uids[3]}},
+	}
+	for _, test := range tests {
+		err := test.op()
+		if (err != nil) != test.err {
+			t.Errorf("%s: err = %v, want error %v", test.name, err, test.err)
+		}
+		if got := testQueueUids(q); !testSameUids(got, test.want) {
+			t.Errorf("%s: queue = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if pos, ok := q.Position(uids[4]); !ok || pos != 1 {
+		t.Errorf("Position of the first job = %d, %v", pos, ok)
+	}
+	if pos, ok := q.Position(uids[3]); !ok || pos != 3 {
+		t.Errorf("Position of the last job = %d, %v", pos, ok)
+	}
+	if q.Busy(uids[1]) {
+		t.Error("the cancelled job is busy")
+	}
+
+	//The cancelled job set the status of the user and the video
+	if status, _ := users.GetUserStatus(uids[1]); status != UserMakeVideoCancel {
+		t.Errorf("status of the cancelled user = %d", status)
+	}
+	if status := testVideoStatus(uids[1], vids[1]); status != VideoCancel {
+		t.Errorf("status of the cancelled video = %d", status)
+	}
+
+	//The queue is saved
+	q2 := new(JobQueue)
+	q2.Init(dir)
+	if got, want := testQueueUids(q2), []uint64{uids[4], uids[2], uids[3]}; !testSameUids(got, want) {
+		t.Errorf("queue after Init = %v, want %v", got, want)
+	}
+
+	q.Stop()
+	if err := q.Add(uids[1], &MakeVideoOptions{VideoId: vids[1]}); err == nil {
+		t.Error("Add after Stop, want an error")
+	}
+}
+
+//The queue is not changed if it cannot be saved
+func TestJobQueueSaveError(t *testing.T) {
+	q, _ := testJobQueue(t)
+	uid1, vid1 := testWaitingUser(t, 1)
+	uid2, vid2 := testWaitingUser(t, 2)
+	if err := q.Add(uid1, &MakeVideoOptions{VideoId: vid1}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.file = filepath.Join(t.TempDir(), "not_exist", "queue.gob")
+	if err := q.Add(uid2, &MakeVideoOptions{VideoId: vid2}); err == nil {
+		t.Error("Add, want an error")
+	}
+	if got := testQueueUids(q); !testSameUids(got, []uint64{uid1}) {
+		t.Errorf("queue after Add = %v", got)
+	}
+	if err := q.Cancel(uid1); err == nil {
+		t.Error("Cancel, want an error")
+	}
+	if got := testQueueUids(q); !testSameUids(got, []uint64{uid1}) {
+		t.Errorf("queue after Cancel = %v", got)
+	}
+	if status, _ := users.GetUserStatus(uid1); status != UserWaitingVideo {
+		t.Errorf("status after Cancel = %d, want waiting", status)
+	}
+}
+
+//Start drops the jobs that their users don't wait for
+func TestJobQueueStart(t *testing.T) {
+	q, _ := testJobQueue(t)
+	uid1, vid1 := testWaitingUser(t, 1)
+	uid2, vid2 := testWaitingUser(t, 2)
+	uid3, _ := testWaitingUser(t, 3)
+
+	q.waiting = []*Job{
+		{Uid: uid1, Moptions: MakeVideoOptions{VideoId: vid1}},
+		//The video is not the one that the user waits for
+		{Uid: uid2, Moptions: MakeVideoOptions{VideoId: vid2 + 1}},
+		//The user doesn't exist
+		{Uid: 1000, Moptions: MakeVideoOptions{VideoId: 1}},
+	}
+	if err := users.SetJobStatus(uid3, 1, UserMakeVideoCancel, nil); err != nil {
+		t.Fatal(err)
+	}
+	q.waiting = append(q.waiting, &Job{Uid: uid3, Moptions: MakeVideoOptions{VideoId: 1}})
+
+	//Don't run the jobs
+	q.Stop()
+	q.Start(1)
+	if got := testQueueUids(q); !testSameUids(got, []uint64{uid1}) {
+		t.Errorf("queue after Start = %v, want %v", got, []uint64{uid1})
+	}
+}
+
+//Restore replaces the stale job of the same uid
+func TestJobQueueRestoreStale(t *testing.T) {
+	q, _ := testJobQueue(t)
+	uid1, vid1 := testWaitingUser(t, 1)
+	uid2, vid2 := testWaitingUser(t, 2)
+	q.waiting = []*Job{
+		{Uid: uid1, Moptions: MakeVideoOptions{VideoId: vid1}},
+		{Uid: uid2, Moptions: MakeVideoOptions{VideoId: vid2 + 1}},
+	}
+
+	q.Restore(uid2, &MakeVideoOptions{VideoId: vid2}, true)
+	q.Stop()
+	q.Start(1)
+	if got := testQueueUids(q); !testSameUids(got, []uint64{uid2, uid1}) {
+		t.Errorf("queue = %v, want %v", got, []uint64{uid2, uid1})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+//Bytes that uid can still use.  -1 means no limit.
+func quotaLeft(uid uint64) (left int64, err error) {
+	if serverConf.UserQuotaMB <= 0 {
+		left = -1
+		return
+	}
+
+	size, err := dirSize(users.UserDir(uid))
+	if err != nil {
+		return
+	}
+	left = int64(serverConf.UserQuotaMB)*1024*1024 - size
+	if left < 0 {
+		left = 0
+	}
+	return
+}
+
+func quotaError() error {
+	return fmt.Errorf("使用的磁盘空间超过了%dMB，请先删除一些视频或者图片", serverConf.UserQuotaMB)
+}
+
+//Return error if uid used up the quota
+func quotaCheck(uid uint64) (err error) {
+	left, err := quotaLeft(uid)
+	if err != nil {
+		return
+	}
+	if left == 0 {
+		err = quotaError()
+	}
+	return
+}
+
+//Copy src to file.  The file will be removed if it is bigger than the
+//quota of uid.
+func quotaCopy(uid uint64, file string, src io.Reader) (n int64, err error) {
+	return quotaCopyFile(uid, file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, src)
+}
+
+//quotaCopy that opens file with flag
+func quotaCopyFile(uid uint64, file string, flag int, src io.Reader) (n int64, err error) {
+	left, err := quotaLeft(uid)
+	if err != nil {
+		return
+	}
+	if left == 0 {
+		err = quotaError()
+		return
+	}
+
+	dst, err := os.OpenFile(file, flag, 0666)
+	if err != nil {
+		return
+	}
+	if left > 0 {
+		src = io.LimitReader(src, left+1)
+	}
+	n, err = io.Copy(dst, src)
+	if close_err := dst.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil && left > 0 && n > left {
+		err = quotaError()
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return
+}
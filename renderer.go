@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//A job of Renderer.  OutputDir contains ConfigFile and is the place
+//where the video is made.
+type RenderJob struct {
+	Uid        uint64
+	VideoId    uint64
+	OutputDir  string
+	ConfigFile string
+	LogFile    string
+}
+
+//The error returned by Renderer
+type RenderError struct {
+	Kind   string
+	Reason string //Shown to the user
+	Tail   string //The last lines of the output
+	Err    error
+}
+
+func (e *RenderError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return e.Reason + ":" + e.Err.Error()
+}
+
+//Get the FailInfo of err
+func renderFailInfo(err error) *FailInfo {
+	if rerr, ok := err.(*RenderError); ok {
+		return &FailInfo{Kind: rerr.Kind, Reason: rerr.Reason, Tail: rerr.Tail}
+	}
+	return &FailInfo{Kind: FailUnknown, Reason: failKindInfo[FailUnknown]}
+}
+
+type Renderer interface {
+	//Check if the job can be run
+	Prepare(job *RenderJob) error
+
+	//Make the video, call progress when the progress is changed and
+	//return the path of the video.  The error is a *RenderError.
+	Run(ctx context.Context, job *RenderJob, progress func(Progress)) (artifact string, err error)
+}
+
+var renderers = map[string]Renderer{
+	"gps2video": &GPS2VideoRenderer{},
+	"fake":      &FakeRenderer{},
+}
+
+var renderer Renderer
+
+func rendererInit() {
+	var ok bool
+	renderer, ok = renderers[serverConf.Renderer]
+	if !ok {
+		fatal("Renderer is not supported", "renderer", serverConf.Renderer)
+	}
+}
+
+//GPS2VideoRenderer runs the python program gps2video
+type GPS2VideoRenderer struct {
+}
+
+func (this *GPS2VideoRenderer) Prepare(job *RenderJob) error {
+	if _, err := exec.LookPath("python"); err != nil {
+		return &RenderError{Kind: FailSystem, Reason: "找不到python", Err: err}
+	}
+	if _, err := exec.LookPath(serverConf.Ffmpeg); err != nil {
+		return &RenderError{Kind: FailFfmpegMissing, Reason: failKindInfo[FailFfmpegMissing], Err: err}
+	}
+	exist, err := fileIsExist(serverConf.GPS2VideoDir)
+	if err == nil && !exist {
+		err = fmt.Errorf("%s does not exist", serverConf.GPS2VideoDir)
+	}
+	if err != nil {
+		return &RenderError{Kind: FailSystem, Reason: "找不到GPS2Video程序", Err: err}
+	}
+	return nil
+}
+
+func (this *GPS2VideoRenderer) Run(ctx context.Context, job *RenderJob, progress func(Progress)) (artifact string, err error) {
+	log_fp, err := os.Create(job.LogFile)
+	if err != nil {
+		err = &RenderError{Kind: FailSystem, Reason: failKindInfo[FailSystem], Err: err}
+		return
+	}
+	defer log_fp.Close()
+
+	name, args := processLimitCommand("python", []string{serverConf.GPS2VideoDir, job.ConfigFile})
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	//Don't wait forever for the pipes that are held by the orphans
+	cmd.WaitDelay = 10 * time.Second
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		err = &RenderError{Kind: FailSystem, Reason: failKindInfo[FailSystem], Err: err}
+		return
+	}
+	cmd.Stderr = cmd.Stdout
+	if err = cmd.Start(); err != nil {
+		err = &RenderError{Kind: FailSystem, Reason: "GPS2Video程序执行出错", Err: err}
+		return
+	}
+	defer killProcessGroup(cmd)
+
+	//Save the output to LogFile and get the progress from it line by line.
+	//Keep the last lines and the lines that can tell why it failed.
+	succeed := false
+	tail := &tailLines{n: failTailLines}
+	errLines := &tailLines{n: failTailLines}
+	p := Progress{Stage: StageStart, Percent: -1}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(scanOutputLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(log_fp, line)
+		tail.Add(line)
+		if failKindFromOutput([]string{line}) != "" {
+			errLines.Add(line)
+		}
+		if strings.Contains(line, "视频生成成功") {
+			succeed = true
+		}
+		if np, changed := parseProgress(line, p); changed {
+			p = np
+			progress(p)
+		}
+	}
+	//Drain the output even if scanner got an error
+	io.Copy(log_fp, stdout)
+	err = cmd.Wait()
+	if err != nil || !succeed {
+		kind := failKindFromRun(ctx, err, errLines.lines)
+		err = &RenderError{Kind: kind, Reason: failKindInfo[kind], Tail: tail.String(), Err: err}
+		return
+	}
+
+	artifact = filepath.Join(job.OutputDir, "v.mp4")
+	return
+}
+
+//FakeRenderer doesn't need python and ffmpeg.  It goes through all the
+//stages and writes a tiny video.  It is used to test the web.
+type FakeRenderer struct {
+}
+
+func (this *FakeRenderer) Prepare(job *RenderJob) error {
+	return nil
+}
+
+func (this *FakeRenderer) Run(ctx context.Context, job *RenderJob, progress func(Progress)) (artifact string, err error) {
+	log_fp, err := os.Create(job.LogFile)
+	if err != nil {
+		err = &RenderError{Kind: FailSystem, Reason: failKindInfo[FailSystem], Err: err}
+		return
+	}
+	defer log_fp.Close()
+
+	for _, stage := range []string{StageMapTiles, StageFrames, StageFfmpeg} {
+		for percent := 0; percent <= 100; percent += 50 {
+			select {
+			case <-ctx.Done():
+				kind := failKindFromRun(ctx, nil, nil)
+				err = &RenderError{Kind: kind, Reason: failKindInfo[kind], Err: ctx.Err()}
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			fmt.Fprintln(log_fp, stage, percent, "%")
+			progress(Progress{Stage: stage, Percent: percent})
+		}
+	}
+
+	artifact = filepath.Join(job.OutputDir, "v.mp4")
+	if err = os.WriteFile(artifact, tinyMP4(), 0600); err != nil {
+		err = &RenderError{Kind: FailSystem, Reason: failKindInfo[FailSystem], Err: err}
+		return
+	}
+	fmt.Fprintln(log_fp, "视频生成成功")
+	return
+}
+
+//An empty MP4 that only has ftyp and moov/mvhd
+func tinyMP4() []byte {
+	box := func(name string, payload []byte) []byte {
+		b := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+		copy(b[4:], name)
+		return append(b, payload...)
+	}
+
+	ftyp := append([]byte("isom\x00\x00\x02\x00"), []byte("isomiso2mp41")...)
+
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)       //timescale
+	binary.BigEndian.PutUint32(mvhd[20:], 0x00010000) //rate
+	binary.BigEndian.PutUint16(mvhd[24:], 0x0100)     //volume
+	//Unity matrix
+	binary.BigEndian.PutUint32(mvhd[36:], 0x00010000)
+	binary.BigEndian.PutUint32(mvhd[52:], 0x00010000)
+	binary.BigEndian.PutUint32(mvhd[68:], 0x40000000)
+	binary.BigEndian.PutUint32(mvhd[96:], 1) //next_track_ID
+
+	return append(box("ftyp", ftyp), box("moov", box("mvhd", mvhd))...)
+}
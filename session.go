@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "session"
+
+const csrfField = "csrf"
+
+const preSessionCookie = "pre_session"
+
+type Session struct {
+	Uid     uint64
+	Expires time.Time
+}
+
+//Sessions are kept in the server and saved to WorkDir/sessions.gob.
+//The cookie only has the random session ID and the HMAC of it.
+type SessionStore struct {
+	lock sync.Mutex
+
+	sessions map[string]*Session
+
+	key []byte
+
+	file string
+}
+
+var sessions SessionStore
+
+func (s *SessionStore) Init(dir string) {
+	s.sessions = make(map[string]*Session)
+	s.file = filepath.Join(dir, "sessions.gob")
+
+	if serverConf.SessionSecret != "" {
+		s.key = []byte(serverConf.SessionSecret)
+	} else {
+		//Keep the key in WorkDir then the sessions are still right after restart
+		key_file := filepath.Join(dir, "session.key")
+		key, err := os.ReadFile(key_file)
+		if err != nil || len(key) == 0 {
+			hex_key, err := randomHex(32)
+			if err != nil {
+				fatal("SessionStore Init randomHex", "err", err)
+			}
+			key = []byte(hex_key)
+			if err = os.WriteFile(key_file, key, 0600); err != nil {
+				fatal("SessionStore Init os.WriteFile", "file", key_file, "err", err)
+			}
+		}
+		s.key = key
+	}
+
+	fd, err := os.Open(s.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("SessionStore Init os.Open", "file", s.file, "err", err)
+		}
+		return
+	}
+	defer fd.Close()
+	dec := gob.NewDecoder(fd)
+	if err = dec.Decode(&s.sessions); err != nil {
+		slog.Error("SessionStore Init dec.Decode", "file", s.file, "err", err)
+		s.sessions = make(map[string]*Session)
+	}
+}
+
+//Must hold s.lock
+func (s *SessionStore) save() error {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+
+	return writeFileAtomic(s.file, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(s.sessions)
+	})
+}
+
+func (s *SessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Get the session ID from the cookie value
+func (s *SessionStore) parse(value string) (id string, err error) {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		err = errors.New("session cookie format is not right")
+		return
+	}
+	id = value[:i]
+	if !hmac.Equal([]byte(value[i+1:]), []byte(s.sign(id))) {
+		err = errors.New("session cookie signature is not right")
+		return
+	}
+	return
+}
+
+//Create a session for uid and return the cookie value of it
+func (s *SessionStore) New(uid uint64) (value string, err error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions[id] = &Session{
+		Uid:     uid,
+		Expires: time.Now().Add(time.Duration(serverConf.SessionMaxAge) * time.Second),
+	}
+	if err = s.save(); err != nil {
+		delete(s.sessions, id)
+		return
+	}
+
+	value = id + "." + s.sign(id)
+	return
+}
+
+//Get the session ID and the uid from the cookie value
+func (s *SessionStore) Get(value string) (id string, uid uint64, err error) {
+	if id, err = s.parse(value); err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.Expires) {
+		err = errors.New("session is not available")
+		return
+	}
+	uid = session.Uid
+	return
+}
+
+func (s *SessionStore) Delete(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.sessions[id]; !ok {
+		return
+	}
+	delete(s.sessions, id)
+	if err := s.save(); err != nil {
+		slog.Error("SessionStore Delete s.save", "err", err)
+	}
+}
+
+//Delete all the sessions of uid
+func (s *SessionStore) DeleteUid(uid uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, session := range s.sessions {
+		if session.Uid == uid {
+			delete(s.sessions, id)
+		}
+	}
+	if err := s.save(); err != nil {
+		slog.Error("SessionStore DeleteUid s.save", "uid", uid, "err", err)
+	}
+}
+
+func newSessionCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     serverConf.DomainDir,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   serverConf.SSL,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+//The CSRF token of the session, it is the HMAC of the session ID then
+//it doesn't need to be saved.
+func (s *SessionStore) CSRFToken(sid string) string {
+	return s.sign("csrf:" + sid)
+}
+
+//Must call r.ParseForm before it
+func (s *SessionStore) CheckCSRF(r *http.Request, sid string) bool {
+	token := formGetOne(r, csrfField)
+	if token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(s.CSRFToken(sid)))
+}
+
+//The forms that are used before login don't have a session.  A random ID
+//in a signed cookie is used as the sid of their CSRF token.
+func (s *SessionStore) PreSession(w http.ResponseWriter, r *http.Request) (sid string, err error) {
+	if cookie, e := r.Cookie(preSessionCookie); e == nil {
+		if id, e := s.parse(cookie.Value); e == nil {
+			sid = "pre:" + id
+			return
+		}
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     preSessionCookie,
+		Value:    id + "." + s.sign(id),
+		Path:     serverConf.DomainDir,
+		HttpOnly: true,
+		Secure:   serverConf.SSL,
+		SameSite: http.SameSiteLaxMode,
+	})
+	sid = "pre:" + id
+	return
+}
+
+//CheckCSRF of the form that has the sid of PreSession.
+//Must call r.ParseForm before it
+func (s *SessionStore) CheckPreCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(preSessionCookie)
+	if err != nil {
+		return false
+	}
+	id, err := s.parse(cookie.Value)
+	if err != nil {
+		return false
+	}
+	return s.CheckCSRF(r, "pre:"+id)
+}
+
+//Save the sessions before exit
+func (s *SessionStore) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.save(); err != nil {
+		slog.Error("SessionStore Close s.save", "err", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//A SessionStore in a temporary directory
+func testSessionStore(t *testing.T, secret string) *SessionStore {
+	serverConf = &Server{SessionSecret: secret, SessionMaxAge: 3600}
+	s := new(SessionStore)
+	s.Init(t.TempDir())
+	return s
+}
+
+func TestSessionGet(t *testing.T) {
+	s := testSessionStore(t, "secret")
+	value, err := s.New(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, uid, err := s.Get(value)
+	if err != nil || uid != 42 || !strings.HasPrefix(value, id+".") {
+		t.Fatalf("Get(%q) = %q, %d, %v", value, id, uid, err)
+	}
+
+	i := strings.IndexByte(value, '.')
+	sig := value[i+1:]
+	tampered_id := "0" + value[1:]
+	if value[0] == '0' {
+		tampered_id = "1" + value[1:]
+	}
+	other := testSessionStore(t, "other secret")
+	other_value, err := other.New(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"empty", ""},
+		{"no signature", id},
+		{"empty signature", id + "."},
+		{"tampered signature", id + "." + strings.Repeat("0", len(sig))},
+		{"short signature", value[:len(value)-1]},
+		{"tampered id", tampered_id},
+		{"signature of another id", strings.Repeat("0", len(id)) + "." + sig},
+		{"another key", other_value},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, uid, err := s.Get(test.value); err == nil {
+				t.Errorf("Get(%q) = %d, want an error", test.value, uid)
+			}
+		})
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	s := testSessionStore(t, "secret")
+	value, err := s.New(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := s.Get(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.sessions[id].Expires = time.Now().Add(-time.Second)
+	if _, uid, err := s.Get(value); err == nil {
+		t.Errorf("Get of the expired session = %d, want an error", uid)
+	}
+}
+
+func TestSessionDelete(t *testing.T) {
+	s := testSessionStore(t, "secret")
+	value1, err := s.New(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value2, err := s.New(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value3, err := s.New(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id1, _, _ := s.Get(value1)
+	s.Delete(id1)
+	if _, _, err := s.Get(value1); err == nil {
+		t.Error("Get of the deleted session, want an error")
+	}
+	s.DeleteUid(1)
+	if _, _, err := s.Get(value2); err == nil {
+		t.Error("Get of the session of the deleted uid, want an error")
+	}
+	if _, uid, err := s.Get(value3); err != nil || uid != 2 {
+		t.Errorf("Get of the session of another uid = %d, %v", uid, err)
+	}
+}
+
+//The sessions are still right after restart
+func TestSessionInitLoad(t *testing.T) {
+	serverConf = &Server{SessionMaxAge: 3600}
+	dir := t.TempDir()
+	s := new(SessionStore)
+	s.Init(dir)
+	value, err := s.New(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = new(SessionStore)
+	s.Init(dir)
+	if _, uid, err := s.Get(value); err != nil || uid != 42 {
+		t.Errorf("Get after Init = %d, %v, want 42", uid, err)
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	s := testSessionStore(t, "secret")
+	sid := "0123456789abcdef"
+	token := s.CSRFToken(sid)
+
+	tests := []struct {
+		name string
+		url  string
+		body string
+		want bool
+	}{
+		{"right", "/", csrfField + "=" + token, true},
+		{"in the URL", "/?up=1&" + csrfField + "=" + token, "", true},
+		{"missing", "/", "a=b", false},
+		{"empty", "/", csrfField + "=", false},
+		{"wrong", "/", csrfField + "=" + strings.Repeat("0", len(token)), false},
+		{"short", "/", csrfField + "=" + token[:len(token)-1], false},
+		{"another session", "/", csrfField + "=" + s.CSRFToken(sid+"0"), false},
+		{"signature of the session", "/", csrfField + "=" + s.sign(sid), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", test.url, strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.ParseForm()
+			if got := s.CheckCSRF(r, sid); got != test.want {
+				t.Errorf("CheckCSRF = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckPreCSRF(t *testing.T) {
+	s := testSessionStore(t, "secret")
+	w := httptest.NewRecorder()
+	sid, err := s.PreSession(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != preSessionCookie {
+		t.Fatalf("PreSession cookies = %v", cookies)
+	}
+	cookie := cookies[0]
+
+	//The cookie is kept by the next page
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	if sid2, err := s.PreSession(w, r); err != nil || sid2 != sid || len(w.Result().Cookies()) != 0 {
+		t.Errorf("PreSession with the cookie = %q, %v, want %q", sid2, err, sid)
+	}
+
+	value, err := s.New(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session_id, _, err := s.Get(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := s.CSRFToken(sid)
+	tampered := "0" + cookie.Value[1:]
+	if cookie.Value[0] == '0' {
+		tampered = "1" + cookie.Value[1:]
+	}
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+		want   bool
+	}{
+		{"right", cookie, token, true},
+		{"no cookie", nil, token, false},
+		{"tampered cookie", &http.Cookie{Name: preSessionCookie, Value: tampered}, token, false},
+		{"no token", cookie, "", false},
+		{"token of a session", cookie, s.CSRFToken(session_id), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(csrfField+"="+test.token))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.cookie != nil {
+				r.AddCookie(test.cookie)
+			}
+			r.ParseForm()
+			if got := s.CheckPreCSRF(r); got != test.want {
+				t.Errorf("CheckPreCSRF = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+//Called when got SIGTERM or SIGINT.  Stop starting new jobs and wait
+//serverConf.ShutdownGrace seconds for the running jobs.  The jobs that are
+//still running after that are killed and put back to the queue.  Then
+//shutdown the HTTP server.
+func shutdown(srv *http.Server) {
+	slog.Info("shutdown start", "grace", serverConf.ShutdownGrace)
+	jobs.Stop()
+
+	if !jobs.WaitRunning(time.Duration(serverConf.ShutdownGrace) * time.Second) {
+		jobs.Interrupt()
+		//Wait for makeVideo to write the status
+		if !jobs.WaitRunning(30 * time.Second) {
+			slog.Error("shutdown some jobs are not stopped")
+		}
+	}
+
+	//The connections of eventsHandler are never idle, close them after
+	//the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("shutdown srv.Shutdown", "err", err)
+		srv.Close()
+	}
+
+	sessions.Close()
+	users.Close()
+	slog.Info("shutdown done")
+}
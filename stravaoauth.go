@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teawater/go.strava"
+)
+
+const stravaTokenURL = "https://www.strava.com/oauth/token"
+
+//Refresh the access token if it expires in this time
+const stravaRefreshMargin = 5 * time.Minute
+
+const oauthStateCookie = "oauth_state"
+
+//The time that user can use to finish the login of Strava
+const oauthStateAge = 10 * time.Minute
+
+type oauthState struct {
+	Next    string //The page that will be shown after login
+	Expires time.Time
+}
+
+//The states of the logins that are not finished.  They are only kept in
+//memory because they are short-lived.
+type OAuthStateStore struct {
+	lock sync.Mutex
+
+	states map[string]*oauthState
+}
+
+var oauthStates = OAuthStateStore{states: make(map[string]*oauthState)}
+
+func (s *OAuthStateStore) New(next string) (state string, err error) {
+	if state, err = randomHex(16); err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for k, v := range s.states {
+		if now.After(v.Expires) {
+			delete(s.states, k)
+		}
+	}
+	s.states[state] = &oauthState{Next: next, Expires: now.Add(oauthStateAge)}
+	return
+}
+
+//Get the state and remove it because each state can only be used once
+func (s *OAuthStateStore) Pop(state string) (next string, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.states[state]
+	if !ok {
+		return
+	}
+	delete(s.states, state)
+	if time.Now().After(st.Expires) {
+		ok = false
+		return
+	}
+	next = st.Next
+	return
+}
+
+//next must be a page of this server, for example "makevideo"
+func loginNextCheck(next string) bool {
+	if strings.HasPrefix(next, "/") || strings.Contains(next, "..") {
+		return false
+	}
+	for _, c := range next {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '_' && c != '.' && c != '/' {
+			return false
+		}
+	}
+	return true
+}
+
+func newOAuthStateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   serverConf.SSL,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+//Start the login of Strava.  The state is saved in the server and in the
+//cookie then the callback can make sure the login is started by this
+//browser.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	next := formGetOne(r, "next")
+	if !loginNextCheck(next) {
+		next = ""
+	}
+
+	//Let the user choose the local account or Strava
+	if serverConf.LocalAccounts && formGetOne(r, "strava") == "" {
+		localLoginPage(w, r, next)
+		return
+	}
+
+	state, err := oauthStates.New(next)
+	if err != nil {
+		httpLogger(r, 0).Error("loginHandler oauthStates.New", "err", err)
+		httpShowError(w, "系统出错:"+err.Error())
+		return
+	}
+	http.SetCookie(w, newOAuthStateCookie(state, int(oauthStateAge/time.Second)))
+	http.Redirect(w, r, authenticator.AuthorizationURL(state, strava.Permissions.Public, true), http.StatusFound)
+}
+
+//Redirect to login, the page next will be shown after login
+func httpLoginRedirect(w http.ResponseWriter, r *http.Request, next string) {
+	deleteCookie(w)
+	http.Redirect(w, r, serverConf.DomainDir+web_login+"?next="+url.QueryEscape(next), http.StatusFound)
+}
+
+//The token that got from Strava OAuth
+type StravaToken struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time //Zero means never expires
+	AthleteId    int64
+}
+
+type stravaTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	Athlete      struct {
+		Id int64 `json:"id"`
+	} `json:"athlete"`
+	Message string `json:"message"`
+}
+
+//Post form to stravaTokenURL.  The errors of go.strava are returned
+//when Strava doesn't accept it.
+func stravaTokenRequest(form url.Values) (token *StravaToken, err error) {
+	form.Set("client_id", fmt.Sprintf("%d", serverConf.ClientId))
+	form.Set("client_secret", serverConf.ClientSecret)
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: stravaTransport{}}
+	resp, err := client.PostForm(stravaTokenURL, form)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var body stravaTokenResponse
+	decode_err := json.NewDecoder(resp.Body).Decode(&body)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		err = strava.OAuthInvalidCredentialsErr
+		return
+	case resp.StatusCode == http.StatusBadRequest:
+		err = strava.OAuthInvalidCodeErr
+		return
+	case resp.StatusCode >= 500:
+		err = strava.OAuthServerErr
+		return
+	case resp.StatusCode != http.StatusOK:
+		err = fmt.Errorf("strava oauth: %s %s", resp.Status, body.Message)
+		return
+	}
+	if decode_err != nil {
+		err = decode_err
+		return
+	}
+
+	token = &StravaToken{
+		AccessToken:  body.AccessToken,
+		RefreshToken: body.RefreshToken,
+		AthleteId:    body.Athlete.Id,
+	}
+	if body.ExpiresAt != 0 {
+		token.ExpiresAt = time.Unix(body.ExpiresAt, 0)
+	}
+	return
+}
+
+//Get a new access token with the refresh token
+func stravaRefresh(refreshToken string) (token *StravaToken, err error) {
+	token, err = stravaTokenRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	return
+}
+
+//The callback of Strava OAuth.  It is used instead of
+//authenticator.HandlerFunc because that one doesn't return the refresh
+//token.
+func stravaOAuthHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	//The callback path is not in DomainDir, so the state cookie uses "/"
+	state := r.FormValue("state")
+	http.SetCookie(w, newOAuthStateCookie("", -1))
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		httpLogger(r, 0).Warn("stravaOAuthHandler state is not right")
+		httpShowError(w, "登陆状态不正确，请重新登陆")
+		return
+	}
+	next, ok := oauthStates.Pop(state)
+	if !ok {
+		httpShowError(w, "登陆已经过期，请重新登陆")
+		return
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		if e == "access_denied" {
+			oAuthFailure(strava.OAuthAuthorizationDeniedErr, w, r)
+		} else {
+			oAuthFailure(fmt.Errorf("strava oauth: %s", e), w, r)
+		}
+		return
+	}
+
+	code := strings.TrimSpace(r.FormValue("code"))
+	if code == "" {
+		oAuthFailure(strava.OAuthInvalidCodeErr, w, r)
+		return
+	}
+
+	token, err := stravaTokenRequest(url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {code},
+	})
+	if err != nil {
+		oAuthFailure(err, w, r)
+		return
+	}
+
+	oAuthSuccess(token, next, w, r)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOAuthStatePop(t *testing.T) {
+	s := OAuthStateStore{states: make(map[string]*oauthState)}
+	state, err := s.New("makevideo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.Pop("unknown"); ok {
+		t.Error("Pop of an unknown state, want not ok")
+	}
+	if _, ok := s.Pop(""); ok {
+		t.Error("Pop of the empty state, want not ok")
+	}
+	next, ok := s.Pop(state)
+	if !ok || next != "makevideo" {
+		t.Errorf("Pop = %q, %v, want \"makevideo\", true", next, ok)
+	}
+	//Each state can only be used once
+	if _, ok := s.Pop(state); ok {
+		t.Error("Pop of a used state, want not ok")
+	}
+}
+
+func TestOAuthStateExpired(t *testing.T) {
+	s := OAuthStateStore{states: make(map[string]*oauthState)}
+	expired, err := s.New("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.states[expired].Expires = time.Now().Add(-time.Second)
+	if _, ok := s.Pop(expired); ok {
+		t.Error("Pop of an expired state, want not ok")
+	}
+
+	//The expired states are removed by New
+	expired, err = s.New("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.states[expired].Expires = time.Now().Add(-time.Second)
+	state, err := s.New("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.states[expired]; ok {
+		t.Error("the expired state is not removed by New")
+	}
+	if next, ok := s.Pop(state); !ok || next != "c" {
+		t.Errorf("Pop = %q, %v, want \"c\", true", next, ok)
+	}
+}
+
+func TestLoginNextCheck(t *testing.T) {
+	tests := []struct {
+		next string
+		want bool
+	}{
+		{"", true},
+		{"makevideo", true},
+		{"videos/1/v.mp4", true},
+		{"evil.com", true}, //It is a page under DomainDir
+		{"/makevideo", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+		{"\\\\evil.com", false},
+		{"http://evil.com", false},
+		{"https://evil.com/makevideo", false},
+		{"javascript:alert(1)", false},
+		{"../admin", false},
+		{"videos/../../x", false},
+		{"%2f%2fevil.com", false},
+		{"makevideo?next=//evil.com", false},
+		{"Makevideo", false},
+		{"make video", false},
+		{"makevideo\n", false},
+	}
+	for _, test := range tests {
+		if got := loginNextCheck(test.next); got != test.want {
+			t.Errorf("loginNextCheck(%q) = %v, want %v", test.next, got, test.want)
+		}
+	}
+}
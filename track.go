@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tkrajina/gpxgo/gpx"
+)
+
+//The tracks that are uploaded by the user are normalized to GPX and saved
+//to WorkDir/<uid>/tracks/<id>.gpx.  The trackid of them is -<id>, so they
+//don't conflict with the Strava activities.  The summary of the track is
+//cached in <id>.json then the list doesn't need to parse all the tracks.
+
+const web_tracks = "tracks"
+
+//Max size of an uploaded track file
+const trackMaxSize = 50 * 1024 * 1024
+
+type Track struct {
+	Id        int64 //Negative
+	Name      string
+	Start     time.Time
+	Points    int
+	Distance  float64 //Meters
+	Duration  time.Duration
+	Elevation float64 //Meters of the climb
+}
+
+func tracksDir(uid uint64) string {
+	return filepath.Join(users.UserDir(uid), "tracks")
+}
+
+func trackFile(uid uint64, id int64) string {
+	return filepath.Join(tracksDir(uid), fmt.Sprintf("%d.gpx", -id))
+}
+
+func trackSummaryFile(uid uint64, id int64) string {
+	return filepath.Join(tracksDir(uid), fmt.Sprintf("%d.json", -id))
+}
+
+func trackSummary(id int64, g *gpx.GPX) Track {
+	points := trackPoints(g)
+	return Track{
+		Id:        id,
+		Name:      g.Name,
+		Start:     g.TimeBounds().StartTime,
+		Points:    len(points),
+		Distance:  g.Length2D(),
+		Duration:  time.Duration(g.Duration() * float64(time.Second)),
+		Elevation: trackClimb(points),
+	}
+}
+
+func saveTrackSummary(uid uint64, track *Track) error {
+	return writeFileAtomic(trackSummaryFile(uid, track.Id), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(track)
+	})
+}
+
+//Get the summary of track id from the cache.  If the cache is not
+//available, parse the track and save the cache.
+func loadTrackSummary(uid uint64, id int64) (track Track, err error) {
+	if data, e := os.ReadFile(trackSummaryFile(uid, id)); e == nil {
+		if e = json.Unmarshal(data, &track); e == nil && track.Id == id {
+			return
+		}
+	}
+
+	g, err := gpx.ParseFile(trackFile(uid, id))
+	if err != nil {
+		return
+	}
+	track = trackSummary(id, g)
+	if e := saveTrackSummary(uid, &track); e != nil {
+		slog.Error("loadTrackSummary saveTrackSummary", "uid", uid, "track", id, "err", e)
+	}
+	return
+}
+
+//The uploaded tracks of uid, the newest is the first
+func listTracks(uid uint64) (tracks []Track, err error) {
+	files, err := filepath.Glob(filepath.Join(tracksDir(uid), "[0-9]*.gpx"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		num, e := strconv.ParseInt(strings.TrimSuffix(name, ".gpx"), 10, 64)
+		if e != nil {
+			continue
+		}
+		//A bad file doesn't break the list of the other tracks
+		track, e := loadTrackSummary(uid, -num)
+		if e != nil {
+			slog.Warn("listTracks loadTrackSummary", "uid", uid, "file", name, "err", e)
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Start.After(tracks[j].Start)
+	})
+	return
+}
+
+//Load the uploaded track id of uid
+func loadTrack(uid uint64, id int64) (g *gpx.GPX, err error) {
+	if id >= 0 {
+		err = fmt.Errorf("轨迹%d不是上传的轨迹", id)
+		return
+	}
+	g, err = gpx.ParseFile(trackFile(uid, id))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("没有轨迹%d", id)
+	}
+	return
+}
+
+func delTrack(uid uint64, id int64) (err error) {
+	if id >= 0 {
+		return fmt.Errorf("轨迹%d不是上传的轨迹", id)
+	}
+	err = os.Remove(trackFile(uid, id))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("没有轨迹%d", id)
+		return
+	}
+	os.Remove(trackSummaryFile(uid, id))
+	return
+}
+
+//Parse the uploaded file name, normalize it and save it as a new track of
+//uid.  The error can be shown to the user.
+func saveTrack(uid uint64, name string, data []byte) (id int64, err error) {
+	g, err := parseTrack(name, data)
+	if err != nil {
+		err = errors.New("解析轨迹出错:" + err.Error())
+		return
+	}
+	xml_data, err := g.ToXml(gpx.ToXmlParams{Version: "1.1", Indent: true})
+	if err != nil {
+		return
+	}
+
+	dir := tracksDir(uid)
+	if err = dir_check_creat(dir, true); err != nil {
+		return
+	}
+	//O_EXCL makes sure that two uploads at the same time get different ids
+	for num := time.Now().Unix(); ; num++ {
+		id = -num
+		_, err = quotaCopyFile(uid, trackFile(uid, id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, bytes.NewReader(xml_data))
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	track := trackSummary(id, g)
+	if e := saveTrackSummary(uid, &track); e != nil {
+		slog.Error("saveTrack saveTrackSummary", "uid", uid, "track", id, "err", e)
+	}
+	return
+}
+
+//All the points of g
+func trackPoints(g *gpx.GPX) (points []gpx.GPXPoint) {
+	for _, track := range g.Tracks {
+		for _, segment := range track.Segments {
+			points = append(points, segment.Points...)
+		}
+	}
+	return
+}
+
+//Meters of the climb of points
+func trackClimb(points []gpx.GPXPoint) (climb float64) {
+	var last float64
+	has_last := false
+	for i := range points {
+		if !points[i].Elevation.NotNull() {
+			continue
+		}
+		ele := points[i].Elevation.Value()
+		if has_last && ele > last {
+			climb += ele - last
+		}
+		last = ele
+		has_last = true
+	}
+	return
+}
+
+//Parse GPX, TCX or FIT by the suffix of name.  The tracks are normalized to
+//a GPX that has one track with one segment, and the points that don't
+//have time are removed because gps2video needs them.
+func parseTrack(name string, data []byte) (g *gpx.GPX, err error) {
+	var points []gpx.GPXPoint
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gpx":
+		var src *gpx.GPX
+		if src, err = gpx.ParseBytes(data); err != nil {
+			return
+		}
+		points = trackPoints(src)
+		if src.Name != "" {
+			name = src.Name
+		}
+	case ".tcx":
+		if points, err = parseTCX(data); err != nil {
+			return
+		}
+	case ".fit":
+		var fit_points []fitPoint
+		if fit_points, err = parseFIT(data); err != nil {
+			return
+		}
+		for _, p := range fit_points {
+			point := gpx.GPXPoint{
+				Point:     gpx.Point{Latitude: p.Latitude, Longitude: p.Longitude},
+				Timestamp: p.Time,
+			}
+			if p.HasEle {
+				point.Elevation = *gpx.NewNullableFloat64(p.Elevation)
+			}
+			points = append(points, point)
+		}
+	default:
+		err = errors.New("只支持GPX、TCX和FIT文件")
+		return
+	}
+
+	g = new(gpx.GPX)
+	g.Name = name
+	for i := range points {
+		if points[i].Timestamp.IsZero() {
+			continue
+		}
+		g.AppendPoint(&points[i])
+	}
+	if len(trackPoints(g)) < 2 {
+		err = errors.New("没有带时间的轨迹点")
+		g = nil
+	}
+	return
+}
+
+type tcxTrackpoint struct {
+	Time     time.Time `xml:"Time"`
+	Position *struct {
+		Latitude  float64 `xml:"LatitudeDegrees"`
+		Longitude float64 `xml:"LongitudeDegrees"`
+	} `xml:"Position"`
+	Altitude *float64 `xml:"AltitudeMeters"`
+}
+
+type tcxTrack struct {
+	Trackpoints []tcxTrackpoint `xml:"Trackpoint"`
+}
+
+type tcxFile struct {
+	Activities []struct {
+		Laps []struct {
+			Tracks []tcxTrack `xml:"Track"`
+		} `xml:"Lap"`
+	} `xml:"Activities>Activity"`
+	Courses []struct {
+		Tracks []tcxTrack `xml:"Track"`
+	} `xml:"Courses>Course"`
+}
+
+func parseTCX(data []byte) (points []gpx.GPXPoint, err error) {
+	var tcx tcxFile
+	if err = xml.Unmarshal(data, &tcx); err != nil {
+		return
+	}
+
+	var tracks []tcxTrack
+	for _, activity := range tcx.Activities {
+		for _, lap := range activity.Laps {
+			tracks = append(tracks, lap.Tracks...)
+		}
+	}
+	for _, course := range tcx.Courses {
+		tracks = append(tracks, course.Tracks...)
+	}
+
+	for _, track := range tracks {
+		for _, tp := range track.Trackpoints {
+			//The points without position are the pauses
+			if tp.Position == nil {
+				continue
+			}
+			point := gpx.GPXPoint{
+				Point:     gpx.Point{Latitude: tp.Position.Latitude, Longitude: tp.Position.Longitude},
+				Timestamp: tp.Time,
+			}
+			if tp.Altitude != nil {
+				point.Elevation = *gpx.NewNullableFloat64(*tp.Altitude)
+			}
+			points = append(points, point)
+		}
+	}
+	return
+}
+
+//Read the part of an uploaded track and save it
+func trackUpload(uid uint64, name string, src io.Reader) (id int64, err error) {
+	data, err := io.ReadAll(io.LimitReader(src, trackMaxSize+1))
+	if err != nil {
+		return
+	}
+	if len(data) > trackMaxSize {
+		err = fmt.Errorf("文件大于%dMB", trackMaxSize/1024/1024)
+		return
+	}
+	return saveTrack(uid, name, data)
+}
+
+func tracksHandler(w http.ResponseWriter, r *http.Request) {
+	uid, sid, err := checkCookie(r)
+	if err != nil {
+		if r.Method == "POST" {
+			httpCookieError(w)
+		} else {
+			httpLoginRedirect(w, r, web_tracks)
+		}
+		return
+	}
+
+	lg := httpLogger(r, uid)
+
+	r.ParseForm()
+	if r.Method == "POST" {
+		//The body of upload is read by MultipartReader, so the CSRF token
+		//of it is in the URL.
+		if !sessions.CheckCSRF(r, sid) {
+			httpCSRFError(w)
+			return
+		}
+
+		if _, ok := r.Form["up"]; ok {
+			reader, err := r.MultipartReader()
+			if err != nil {
+				lg.Error("tracksHandler MultipartReader", "err", err)
+				w.WriteHeader(403)
+				return
+			}
+			for {
+				part, err := reader.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					lg.Error("tracksHandler NextPart", "err", err)
+					w.WriteHeader(403)
+					return
+				}
+				if part.FormName() != "file" || part.FileName() == "" {
+					continue
+				}
+				id, err := trackUpload(uid, part.FileName(), part)
+				if err != nil {
+					lg.Warn("tracksHandler trackUpload", "file", part.FileName(), "err", err)
+					httpShowError(w, "上传"+part.FileName()+"出错:"+err.Error())
+					return
+				}
+				lg.Info("tracksHandler trackUpload", "file", part.FileName(), "track", id)
+			}
+		}
+
+		if _, ok := r.Form["del"]; ok {
+			for index, val := range r.Form {
+				if len(val) != 1 || val[0] != "on" {
+					continue
+				}
+				id, err := strconv.ParseInt(index, 10, 64)
+				if err != nil || id >= 0 {
+					continue
+				}
+				if err = delTrack(uid, id); err != nil {
+					lg.Warn("tracksHandler delTrack", "track", id, "err", err)
+				}
+			}
+		}
+	}
+
+	tracks, err := listTracks(uid)
+	if err != nil {
+		lg.Error("tracksHandler listTracks", "err", err)
+		httpShowError(w, "读取轨迹出错:"+err.Error())
+		return
+	}
+
+	httpHead(w)
+	show := `<a href="` + serverConf.DomainDir + `">返回</a><hr>`
+	if len(tracks) > 0 {
+		show += `<form action="` + serverConf.DomainDir + web_tracks + `?del=1" method="post">`
+		show += csrfInput(sid)
+		for _, track := range tracks {
+			show += fmt.Sprintf(`<input type="checkbox" name="%d">%s %s %d个点<br>`,
+				track.Id, html.EscapeString(track.Name), track.Start.Local().Format(activity_layout), track.Points)
+		}
+		show += `<input type="reset" value="Reset" /> <input type="submit" value="Remove" /><br></form><hr>`
+	}
+	show += `<form action="`
+	show += serverConf.DomainDir + web_tracks
+	show += `?up=1&` + csrfField + `=` + sessions.CSRFToken(sid) + `" method="post" enctype="multipart/form-data">
+	支持GPX、TCX和FIT文件<br>
+	<input type="file" name="file" accept=".gpx,.tcx,.fit" multiple/><br>
+	<input type="submit" value="Submit" /> <input type="reset" value="Reset" /><br>
+	</form>`
+	fmt.Fprintln(w, show)
+	httpTail(w)
+}
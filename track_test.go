@@ -0,0 +1,242 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const tcxTestActivity = `<?xml version="1.0" encoding="UTF-8"?>
+<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2">
+ <Activities>
+  <Activity Sport="Biking">
+   <Id>2020-05-01T08:00:00Z</Id>
+   <Lap StartTime="2020-05-01T08:00:00Z">
+    <Track>
+     <Trackpoint>
+      <Time>2020-05-01T08:00:00Z</Time>
+      <Position><LatitudeDegrees>31.5</LatitudeDegrees><LongitudeDegrees>121.25</LongitudeDegrees></Position>
+      <AltitudeMeters>10.5</AltitudeMeters>
+     </Trackpoint>
+     <Trackpoint>
+      <Time>2020-05-01T08:00:01Z</Time>
+      <HeartRateBpm><Value>120</Value></HeartRateBpm>
+     </Trackpoint>
+     <Trackpoint>
+      <Time>2020-05-01T08:00:02Z</Time>
+      <Position><LatitudeDegrees>31.6</LatitudeDegrees><LongitudeDegrees>121.35</LongitudeDegrees></Position>
+     </Trackpoint>
+    </Track>
+   </Lap>
+   <Lap StartTime="2020-05-01T09:00:00Z">
+    <Track>
+     <Trackpoint>
+      <Time>2020-05-01T09:00:00Z</Time>
+      <Position><LatitudeDegrees>31.7</LatitudeDegrees><LongitudeDegrees>121.45</LongitudeDegrees></Position>
+      <AltitudeMeters>20</AltitudeMeters>
+     </Trackpoint>
+    </Track>
+   </Lap>
+  </Activity>
+ </Activities>
+</TrainingCenterDatabase>`
+
+const tcxTestCourse = `<?xml version="1.0" encoding="UTF-8"?>
+<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2">
+ <Courses>
+  <Course>
+   <Name>Course</Name>
+   <Track>
+    <Trackpoint>
+     <Time>2020-05-01T08:00:00Z</Time>
+     <Position><LatitudeDegrees>1</LatitudeDegrees><LongitudeDegrees>2</LongitudeDegrees></Position>
+    </Trackpoint>
+    <Trackpoint>
+     <Position><LatitudeDegrees>3</LatitudeDegrees><LongitudeDegrees>4</LongitudeDegrees></Position>
+    </Trackpoint>
+    <Trackpoint>
+     <Time>2020-05-01T08:00:05Z</Time>
+     <Position><LatitudeDegrees>5</LatitudeDegrees><LongitudeDegrees>6</LongitudeDegrees></Position>
+     <AltitudeMeters>7</AltitudeMeters>
+    </Trackpoint>
+   </Track>
+  </Course>
+ </Courses>
+</TrainingCenterDatabase>`
+
+type trackTestPoint struct {
+	lat  float64
+	long float64
+	ele  float64 //-1 means no elevation
+	time string
+}
+
+func TestParseTCX(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []trackTestPoint
+		err  bool
+	}{
+		{"activity", tcxTestActivity, []trackTestPoint{
+			{31.5, 121.25, 10.5, "2020-05-01T08:00:00Z"},
+			//The point without position is removed
+			{31.6, 121.35, -1, "2020-05-01T08:00:02Z"},
+			{31.7, 121.45, 20, "2020-05-01T09:00:00Z"},
+		}, false},
+		{"course", tcxTestCourse, []trackTestPoint{
+			{1, 2, -1, "2020-05-01T08:00:00Z"},
+			//The point without time is kept by parseTCX
+			{3, 4, -1, ""},
+			{5, 6, 7, "2020-05-01T08:00:05Z"},
+		}, false},
+		{"empty", `<TrainingCenterDatabase></TrainingCenterDatabase>`, nil, false},
+		{"not XML", `{"a": 1}`, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			points, err := parseTCX([]byte(test.data))
+			if test.err {
+				if err == nil {
+					t.Error("parseTCX, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != len(test.want) {
+				t.Fatalf("parseTCX got %d points, want %d", len(points), len(test.want))
+			}
+			for i, want := range test.want {
+				got := points[i]
+				var want_time time.Time
+				if want.time != "" {
+					want_time, _ = time.Parse(time.RFC3339, want.time)
+				}
+				if got.Latitude != want.lat || got.Longitude != want.long || !got.Timestamp.Equal(want_time) {
+					t.Errorf("point %d = %v %v %v, want %+v", i, got.Latitude, got.Longitude, got.Timestamp, want)
+				}
+				if got.Elevation.NotNull() != (want.ele >= 0) || (want.ele >= 0 && got.Elevation.Value() != want.ele) {
+					t.Errorf("elevation of point %d = %v %v, want %v", i, got.Elevation.NotNull(), got.Elevation.Value(), want.ele)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTrack(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		data     []byte
+		want     int
+		wantName string
+		err      bool
+	}{
+		{"tcx", "ride.TCX", []byte(tcxTestActivity), 3, "ride.TCX", false},
+		//The point without time is removed
+		{"tcx without time", "course.tcx", []byte(tcxTestCourse), 2, "course.tcx", false},
+		{"fit", "ride.fit", fitTestFile().file(14), 2, "ride.fit", false},
+		{"bad fit", "ride.fit", []byte("not a fit file"), 0, "", true},
+		{"less than 2 points", "one.tcx", []byte(`<TrainingCenterDatabase><Courses><Course><Track><Trackpoint>
+			<Time>2020-05-01T08:00:00Z</Time>
+			<Position><LatitudeDegrees>1</LatitudeDegrees><LongitudeDegrees>2</LongitudeDegrees></Position>
+			</Trackpoint></Track></Course></Courses></TrainingCenterDatabase>`), 0, "", true},
+		{"not supported", "ride.kml", []byte("<kml></kml>"), 0, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, err := parseTrack(test.file, test.data)
+			if test.err {
+				if err == nil {
+					t.Error("parseTrack, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			points := trackPoints(g)
+			if len(points) != test.want || g.Name != test.wantName || len(g.Tracks) != 1 || len(g.Tracks[0].Segments) != 1 {
+				t.Fatalf("parseTrack = %q with %d points in %d tracks, want %q with %d points", g.Name, len(points), len(g.Tracks), test.wantName, test.want)
+			}
+			for i := range points {
+				if points[i].Timestamp.IsZero() {
+					t.Errorf("point %d doesn't have time", i)
+				}
+			}
+		})
+	}
+}
+
+//Uploads at the same time get different ids, a bad file is skipped by
+//listTracks and the summary is cached
+func TestSaveListTracks(t *testing.T) {
+	testJobQueue(t)
+	uid, _ := testWaitingUser(t, 1)
+
+	const count = 5
+	ids := make([]int64, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = saveTrack(uid, "ride.tcx", []byte(tcxTestActivity))
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[int64]bool)
+	for i := range ids {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if seen[ids[i]] {
+			t.Errorf("id %d is used by two tracks", ids[i])
+		}
+		seen[ids[i]] = true
+	}
+
+	//A bad file doesn't break the list
+	if err := os.WriteFile(trackFile(uid, -1), []byte("not a gpx"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := listTracks(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != count {
+		t.Fatalf("listTracks got %d tracks, want %d", len(tracks), count)
+	}
+	for _, track := range tracks {
+		if !seen[track.Id] || track.Name != "ride.tcx" || track.Points != 3 || track.Distance <= 0 {
+			t.Errorf("track %+v", track)
+		}
+	}
+
+	//The summary is read from the cache
+	id := ids[0]
+	if err = os.WriteFile(trackFile(uid, id), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if track, err := loadTrackSummary(uid, id); err != nil || track.Points != 3 {
+		t.Errorf("loadTrackSummary = %+v, %v", track, err)
+	}
+	//The cache is parsed again if it is bad
+	if err = os.WriteFile(trackSummaryFile(uid, id), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTrackSummary(uid, id); err == nil {
+		t.Error("loadTrackSummary of a bad track, want an error")
+	}
+
+	if err = delTrack(uid, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(trackSummaryFile(uid, id)); !os.IsNotExist(err) {
+		t.Errorf("summary of the deleted track: %v", err)
+	}
+}
@@ -1,27 +1,116 @@
 package main
 
 import (
-	"encoding/gob"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/teawater/go.strava"
 )
 
 const (
 	UserNormal = iota
 	UserMakingVideo
 	UserMakeVideoFail
+	UserWaitingVideo
+	UserMakeVideoCancel
+
+	userStatusNum
+)
+
+var userStatusInfo = []string{"正常", "生成中", "生成失败", "排队中", "已取消"}
+
+const (
+	VideoWaiting = iota
+	VideoMaking
+	VideoSuccess
+	VideoFail
+	VideoCancel
 )
 
+var videoStatusInfo = []string{"排队中", "生成中", "生成成功", "生成失败", "已取消"}
+
+type Video struct {
+	Id         uint64
+	TrackId    int64
+	Name       string
+	CreatedAt  time.Time
+	Status     int
+	FailKind   string
+	FailReason string
+	FailTail   string
+}
+
 type User struct {
+	//The access token of the last Strava login.  The old users that don't
+	//have AthleteId are found by it when they login again.
 	Token  string
 	Status int
 
 	Moptions            MakeVideoOptions
 	MakeVideoFailReason string
+	MakeVideoFailKind   string
+
+	Videos      []*Video
+	LastVideoId uint64
+
+	ApiToken string
+
+	//Strava OAuth, AccessToken is refreshed before it expires
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+	AthleteId    int64
+
+	//Local account, Username is empty for the Strava users
+	Username      string
+	PasswordHash  string //bcrypt
+	Email         string
+	EmailVerified bool
+	VerifyHash    string //SHA-256 of the token in the verification email
+	VerifyExpires time.Time
+
+	LastActive time.Time //Updated at most once an hour
+}
+
+//Must hold u.lock
+func (user *User) findVideo(vid uint64) int {
+	for i, video := range user.Videos {
+		if video.Id == vid {
+			return i
+		}
+	}
+	return -1
+}
+
+//Return true if video vid is waiting or making
+func (user *User) videoBusy(vid uint64) bool {
+	return (user.Status == UserWaitingVideo || user.Status == UserMakingVideo) && user.Moptions.VideoId == vid
+}
+
+//Return the videos without the oldest ones if there are more than
+//serverConf.MaxVideos.  Video keep and the busy ones are not removed.
+func (user *User) pruneVideos(keep uint64) (videos []*Video, removed []uint64) {
+	videos = append([]*Video{}, user.Videos...)
+	if serverConf.MaxVideos <= 0 {
+		return
+	}
+	for i := 0; len(videos) > serverConf.MaxVideos && i < len(videos); {
+		if videos[i].Id == keep || user.videoBusy(videos[i].Id) {
+			i++
+			continue
+		}
+		removed = append(removed, videos[i].Id)
+		videos = append(videos[:i], videos[i+1:]...)
+	}
+	return
 }
 
 type UserMap struct {
@@ -31,9 +120,26 @@ type UserMap struct {
 
 	token2uid map[string]uint64
 
+	athlete2uid map[int64]uint64
+
+	apitoken2uid map[string]uint64
+
+	username2uid map[string]uint64
+
+	//The old users that don't have AthleteId
+	noAthlete map[uint64]bool
+
 	last_uid uint64
 
 	dir string
+
+	store UserStore
+
+	//Only one goroutine refreshes the Strava token at a time
+	refreshLock sync.Mutex
+
+	//Only one goroutine migrates the old users at a time
+	migrateLock sync.Mutex
 }
 
 var users UserMap
@@ -43,176 +149,1157 @@ func (u *UserMap) Init(dir string) {
 
 	u.uid2user = make(map[uint64]*User)
 	u.token2uid = make(map[string]uint64)
+	u.athlete2uid = make(map[int64]uint64)
+	u.apitoken2uid = make(map[string]uint64)
+	u.username2uid = make(map[string]uint64)
+	u.noAthlete = make(map[uint64]bool)
 
 	err := dir_check_creat(u.dir, false)
 	if err != nil {
-		log.Fatal(err)
+		fatal("UserMap Init dir_check_creat", "dir", u.dir, "err", err)
+	}
+
+	if u.store, err = newUserStore(u.dir); err != nil {
+		fatal("UserMap Init newUserStore", "err", err)
 	}
 
-	err = filepath.Walk(u.dir, func(path string, f os.FileInfo, err error) error {
-		if f == nil {
-			return err
+	err = u.store.Load(func(uid uint64, user *User) {
+		path := u.UserDir(uid)
+		if err := dir_check_creat(path, true); err != nil {
+			slog.Error("UserMap Init dir_check_creat", "uid", uid, "err", err)
+			return
+		}
+
+		//Old versions only keep the token that never expires
+		if user.AccessToken == "" {
+			user.AccessToken = user.Token
+		}
+		//Old versions don't have it, don't let the janitor remove them now
+		if user.LastActive.IsZero() {
+			user.LastActive = time.Now()
+			if err := u.Write(uid, user); err != nil {
+				slog.Error("UserMap Init u.Write", "uid", uid, "err", err)
+			}
+		}
+
+		if err := u.migrateVideo(uid, user); err != nil {
+			slog.Error("UserMap Init u.migrateVideo", "uid", uid, "err", err)
+		}
+
+		u.uid2user[uid] = user
+		if user.Token != "" {
+			u.token2uid[user.Token] = uid
+		}
+		if user.Username != "" {
+			u.username2uid[user.Username] = uid
+		} else if user.AthleteId == 0 {
+			u.noAthlete[uid] = true
+		} else {
+			u.addAthlete(user.AthleteId, uid)
 		}
-		if !f.IsDir() || path == u.dir {
-			return nil
+		if user.ApiToken != "" {
+			u.apitoken2uid[user.ApiToken] = uid
 		}
 
-		match, err := filepath.Match(`[0-9]*`, f.Name())
-		if err == nil && match {
-			var fd *os.File
-			if fd, err = os.Open(filepath.Join(path, "user.gob")); err != nil {
-				os.RemoveAll(path)
-				return nil
+		if user.Status == UserMakingVideo || user.Status == UserWaitingVideo {
+			slog.Info("UserMap Init remake video", "uid", uid, "job", user.Moptions.VideoId)
+			//A job that was making video is put to the head of the queue
+			front := user.Status == UserMakingVideo
+			i := user.findVideo(user.Moptions.VideoId)
+			if i < 0 {
+				user.Status = UserMakeVideoFail
+				user.MakeVideoFailKind = FailSystem
+				user.MakeVideoFailReason = fmt.Sprintf("没有视频%d", user.Moptions.VideoId)
+			} else {
+				fail := &FailInfo{}
+				if front {
+					fail = &FailInfo{Kind: FailInterrupted, Reason: failKindInfo[FailInterrupted]}
+				}
+				user.Status = UserWaitingVideo
+				user.MakeVideoFailKind = fail.Kind
+				user.MakeVideoFailReason = fail.Reason
+				user.Videos[i].syncStatus(UserWaitingVideo, fail)
 			}
-			dec := gob.NewDecoder(fd)
-			user := new(User)
-			if dec.Decode(user) != nil {
-				os.RemoveAll(path)
-				return nil
+			if err := u.Write(uid, user); err != nil {
+				slog.Error("UserMap Init u.Write", "uid", uid, "err", err)
 			}
-			fd.Close()
-			var uid uint64
-			if uid, err = strconv.ParseUint(f.Name(), 10, 64); err != nil {
-				os.RemoveAll(path)
-				return nil
+			if i >= 0 {
+				jobs.Restore(uid, &user.Moptions, front)
 			}
-			u.uid2user[uid] = user
-			u.token2uid[user.Token] = uid
+		}
 
-			if user.Status == UserMakingVideo {
-				log.Println("ReMakingVideo", uid)
-				go makeVideo(uid, user.Token, &user.Moptions)
-			}
+		slog.Debug("UserMap Init add user", "uid", uid, "athlete", user.AthleteId)
+	})
+	if err != nil {
+		fatal("UserMap Init u.store.Load", "err", err)
+	}
+
+	//Strava is slow or down sometimes, don't wait for it
+	if len(u.noAthlete) > 0 {
+		go u.MigrateAthletes()
+	}
+}
 
-			log.Println("Add ", uid, user.Token)
+//Must hold u.lock.Lock
+//If more than one uid belong to the same athlete, the smallest uid is used.
+//The others can still be accessed with the old cookie.
+func (u *UserMap) addAthlete(athleteId int64, uid uint64) {
+	if old_uid, ok := u.athlete2uid[athleteId]; ok {
+		if old_uid < uid {
+			slog.Warn("athlete already has another uid", "uid", uid, "athlete", athleteId, "used_uid", old_uid)
+			return
 		}
-		return filepath.SkipDir
-	})
+		slog.Warn("athlete already has another uid", "uid", old_uid, "athlete", athleteId, "used_uid", uid)
+	}
+	u.athlete2uid[athleteId] = uid
+}
+
+//Old versions identify users by the access token.  Get the athlete ID of
+//them from Strava.  It is called in the background by u.Init and retried
+//by the janitor, the users that login before it are migrated by FindAdd.
+func (u *UserMap) MigrateAthletes() {
+	if !u.migrateLock.TryLock() {
+		return
+	}
+	defer u.migrateLock.Unlock()
+
+	u.lock.RLock()
+	uids := make([]uint64, 0, len(u.noAthlete))
+	for uid := range u.noAthlete {
+		uids = append(uids, uid)
+	}
+	u.lock.RUnlock()
+
+	for _, uid := range uids {
+		if err := u.migrateAthlete(uid); err != nil {
+			//Try again next time
+			slog.Warn("UserMap migrateAthlete", "uid", uid, "err", err)
+		}
+	}
+}
+
+func (u *UserMap) migrateAthlete(uid uint64) (err error) {
+	//The token is refreshed by GetToken if it expires
+	token, err := u.GetToken(uid)
+	if err != nil {
+		return
+	}
+	athlete, err := strava.NewCurrentAthleteService(strava.NewClient(token, stravaHTTPClient)).Get().Do()
+	if err != nil {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok || user.AthleteId != 0 {
+		//Removed or migrated by FindAdd
+		delete(u.noAthlete, uid)
+		return
+	}
+	user.AthleteId = athlete.Id
+	if err = u.Write(uid, user); err != nil {
+		user.AthleteId = 0
+		return
+	}
+	delete(u.noAthlete, uid)
+	u.addAthlete(user.AthleteId, uid)
+	return
+}
+
+//Old versions keep only one video in userDir/v.mp4.  Move it to
+//the video list and fail the job that was made with the old version.
+func (u *UserMap) migrateVideo(uid uint64, user *User) (err error) {
+	userDir := u.UserDir(uid)
+	if (user.Status == UserWaitingVideo || user.Status == UserMakingVideo) && user.Moptions.VideoId == 0 {
+		user.Status = UserMakeVideoFail
+		user.MakeVideoFailKind = FailSystem
+		user.MakeVideoFailReason = "服务器升级，请重新生成视频"
+		if err = u.Write(uid, user); err != nil {
+			return
+		}
+	}
+
+	if len(user.Videos) != 0 {
+		return
+	}
+	old_video := filepath.Join(userDir, "v.mp4")
+	fi, err := os.Stat(old_video)
 	if err != nil {
-		log.Fatal(err)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	if err = dir_check_creat(filepath.Join(userDir, "videos"), true); err != nil {
+		return
+	}
+	video := &Video{Id: user.LastVideoId + 1, Status: VideoSuccess, CreatedAt: fi.ModTime()}
+	video_dir := filepath.Join(userDir, "videos", fmt.Sprintf("%d", video.Id))
+	if err = dir_check_creat(video_dir, true); err != nil {
+		return
 	}
+	if err = os.Rename(old_video, filepath.Join(video_dir, "v.mp4")); err != nil {
+		return
+	}
+	user.Videos = append(user.Videos, video)
+	user.LastVideoId = video.Id
+	err = u.Write(uid, user)
+	return
+}
+
+func (u *UserMap) UserDir(uid uint64) string {
+	return filepath.Join(u.dir, fmt.Sprintf("%d", uid))
+}
+
+func (u *UserMap) VideoDir(uid uint64, vid uint64) string {
+	return filepath.Join(u.UserDir(uid), "videos", fmt.Sprintf("%d", vid))
 }
 
-func (u *UserMap) Check(uid uint64, token string) bool {
+//Return true if uid is waiting for the job that makes video vid
+func (u *UserMap) JobWaiting(uid uint64, vid uint64) bool {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
-	got_uid, ok := u.token2uid[token]
-	if (!ok) || (got_uid != uid) {
+	user, ok := u.uid2user[uid]
+	if !ok || user.Status != UserWaitingVideo || user.Moptions.VideoId != vid {
 		return false
 	}
-	return true
+	i := user.findVideo(vid)
+	return i >= 0 && user.Videos[i].Status == VideoWaiting
 }
 
 //Must hold u.lock.Lock
-func (u *UserMap) Write(userDir string, user *User) error {
-	fd, err := os.Create(filepath.Join(userDir, "user.gob"))
-	if err != nil {
-		return err
-	}
-	defer fd.Close()
-	enc := gob.NewEncoder(fd)
-	err = enc.Encode(user)
-	return nil
+func (u *UserMap) Write(uid uint64, user *User) error {
+	return u.store.Put(uid, user)
 }
 
-func (u *UserMap) FindAdd(token string) (uid uint64, err error) {
+func (u *UserMap) FindAdd(stoken *StravaToken) (uid uint64, err error) {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
-	uid, ok := u.token2uid[token]
-	if !ok {
-		//Get uid
-		uid = u.last_uid
-		for {
-			uid++
-			_, ok := u.uid2user[uid]
-			if !ok {
-				break
-			}
+	token := stoken.AccessToken
+	uid, ok := u.athlete2uid[stoken.AthleteId]
+	if ok && stoken.AthleteId != 0 {
+		//Login again, update the token
+		user := u.uid2user[uid]
+		old_user := *user
+		user.Token = token
+		user.AccessToken = stoken.AccessToken
+		user.RefreshToken = stoken.RefreshToken
+		user.ExpiresAt = stoken.ExpiresAt
+		if err = u.Write(uid, user); err != nil {
+			*user = old_user
+			return
 		}
-		userDir := filepath.Join(u.dir, fmt.Sprintf("%d", uid))
+		delete(u.token2uid, old_user.Token)
+		u.token2uid[token] = uid
+		return
+	}
 
-		//Create userDir
-		if err = os.RemoveAll(userDir); err != nil {
+	uid, ok = u.token2uid[token]
+	if ok {
+		//An old user that is not migrated yet, set AthleteId of it now
+		user := u.uid2user[uid]
+		old_user := *user
+		user.AccessToken = stoken.AccessToken
+		user.RefreshToken = stoken.RefreshToken
+		user.ExpiresAt = stoken.ExpiresAt
+		if user.AthleteId == 0 {
+			user.AthleteId = stoken.AthleteId
+		}
+		if err = u.Write(uid, user); err != nil {
+			*user = old_user
 			return
 		}
-		if err = os.Mkdir(userDir, os.FileMode(0700)); err != nil {
+		if user.AthleteId != 0 {
+			delete(u.noAthlete, uid)
+			u.addAthlete(user.AthleteId, uid)
+		}
+	} else {
+		if uid, err = u.newUid(); err != nil {
 			return
 		}
+		userDir := u.UserDir(uid)
 
 		//Get user
 		user := new(User)
 		user.Token = token
 		user.Status = UserNormal
+		user.AccessToken = stoken.AccessToken
+		user.RefreshToken = stoken.RefreshToken
+		user.ExpiresAt = stoken.ExpiresAt
+		user.AthleteId = stoken.AthleteId
+		user.LastActive = time.Now()
 
-		if err = u.Write(userDir, user); err != nil {
+		if err = u.Write(uid, user); err != nil {
 			os.RemoveAll(userDir)
 			return
 		}
 
 		u.token2uid[token] = uid
+		if user.AthleteId != 0 {
+			u.athlete2uid[user.AthleteId] = uid
+		}
 		u.uid2user[uid] = user
 		u.last_uid = uid
 	}
 	return
 }
 
-func (u *UserMap) GetUserStatus(uid uint64) (status int, err error) {
+//Must hold u.lock.Lock
+//Get an unused uid and create the directory of it
+func (u *UserMap) newUid() (uid uint64, err error) {
+	uid = u.last_uid
+	for {
+		uid++
+		_, ok := u.uid2user[uid]
+		if ok {
+			continue
+		}
+		//The record that cannot be loaded still has the directory,
+		//don't use its uid.
+		if exist, e := fileIsExist(u.UserDir(uid)); e == nil && !exist {
+			break
+		}
+	}
+
+	err = os.Mkdir(u.UserDir(uid), os.FileMode(0700))
+	return
+}
+
+//Add a local account.  verifyHash is the hash of the token in the
+//verification email.
+func (u *UserMap) AddLocal(username string, email string, passwordHash string, verifyHash string) (uid uint64, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if _, ok := u.username2uid[username]; ok {
+		err = errors.New("用户名已经被使用")
+		return
+	}
+	for _, user := range u.uid2user {
+		if user.Username != "" && strings.EqualFold(user.Email, email) {
+			err = errors.New("邮箱已经被使用")
+			return
+		}
+	}
+
+	if uid, err = u.newUid(); err != nil {
+		return
+	}
+	user := &User{
+		Status:        UserNormal,
+		Username:      username,
+		PasswordHash:  passwordHash,
+		Email:         email,
+		VerifyHash:    verifyHash,
+		VerifyExpires: time.Now().Add(localVerifyAge),
+		LastActive:    time.Now(),
+	}
+	if err = u.Write(uid, user); err != nil {
+		os.RemoveAll(u.UserDir(uid))
+		return
+	}
+
+	u.uid2user[uid] = user
+	u.username2uid[username] = uid
+	u.last_uid = uid
+	return
+}
+
+//Get the local account username
+func (u *UserMap) GetLocal(username string) (uid uint64, passwordHash string, email string, verified bool, err error) {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
+	uid, ok := u.username2uid[username]
+	if !ok {
+		err = errors.New("用户名或者密码不正确")
+		return
+	}
+	user := u.uid2user[uid]
+	passwordHash = user.PasswordHash
+	email = user.Email
+	verified = user.EmailVerified
+	return
+}
+
+var errVerifyResend = fmt.Errorf("%d分钟内只能发送一次验证邮件", int(localVerifyResend/time.Minute))
+
+//Set a new verification token of the local account uid.  Return
+//errVerifyResend if the last one was set in localVerifyResend.
+func (u *UserMap) SetVerifyHash(uid uint64, verifyHash string) (err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
 	user, ok := u.uid2user[uid]
 	if !ok {
 		err = fmt.Errorf("查找客户%d失败", uid)
 		return
 	}
-
-	status = user.Status
+	if time.Now().Before(user.VerifyExpires.Add(localVerifyResend - localVerifyAge)) {
+		err = errVerifyResend
+		return
+	}
+	old_user := *user
+	user.VerifyHash = verifyHash
+	user.VerifyExpires = time.Now().Add(localVerifyAge)
+	if err = u.Write(uid, user); err != nil {
+		*user = old_user
+	}
 	return
 }
 
-func (u *UserMap) SetUserStatus(uid uint64, status int, options *MakeVideoOptions, reason string) (err error) {
+//Mark the email of uid verified if verifyHash is right
+func (u *UserMap) VerifyEmail(uid uint64, verifyHash string) (err error) {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
+	user, ok := u.uid2user[uid]
+	if !ok || user.Username == "" {
+		err = errors.New("验证链接不正确")
+		return
+	}
+	//The hash is removed after the email is verified, so the link can
+	//only be used once
+	if user.VerifyHash == "" || subtle.ConstantTimeCompare([]byte(user.VerifyHash), []byte(verifyHash)) != 1 {
+		err = errors.New("验证链接不正确")
+		return
+	}
+	if time.Now().After(user.VerifyExpires) {
+		err = errors.New("验证链接已经过期，请重新登陆以获取新的验证邮件")
+		return
+	}
+
+	old_user := *user
+	user.EmailVerified = true
+	user.VerifyHash = ""
+	if err = u.Write(uid, user); err != nil {
+		*user = old_user
+	}
+	return
+}
+
+//The email of the local account uid, empty for the Strava users
+func (u *UserMap) GetEmail(uid uint64) (email string, err error) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
 	user, ok := u.uid2user[uid]
 	if !ok {
 		err = fmt.Errorf("查找客户%d失败", uid)
 		return
 	}
-	if status < UserNormal || status > UserMakeVideoFail {
-		err = fmt.Errorf("设置客户%d状态%d失败", uid, status)
+	email = user.Email
+	return
+}
+
+func (u *UserMap) getStravaToken(uid uint64) (stoken StravaToken, err error) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
 		return
 	}
 
-	old_status := user.Status
-	user.Status = status
-	user.MakeVideoFailReason = reason
+	stoken = StravaToken{
+		AccessToken:  user.AccessToken,
+		RefreshToken: user.RefreshToken,
+		ExpiresAt:    user.ExpiresAt,
+		AthleteId:    user.AthleteId,
+	}
+	return
+}
 
-	if options != nil {
-		user.Moptions = *options
+func stravaTokenValid(stoken *StravaToken) bool {
+	return stoken.RefreshToken == "" || stoken.ExpiresAt.IsZero() || time.Until(stoken.ExpiresAt) > stravaRefreshMargin
+}
+
+//Returned by GetToken for the local accounts
+var errNoStrava = errors.New("本地账号没有连接Strava，只能使用上传的轨迹")
+
+//Get the Strava access token of uid.  It will be refreshed if it expires
+//soon.  Call it before each use of Strava, don't keep the token.
+func (u *UserMap) GetToken(uid uint64) (token string, err error) {
+	stoken, err := u.getStravaToken(uid)
+	if err != nil {
+		return
+	}
+	if stoken.AccessToken == "" {
+		err = errNoStrava
+		return
+	}
+	if stravaTokenValid(&stoken) {
+		token = stoken.AccessToken
+		return
 	}
 
-	userDir := filepath.Join(u.dir, fmt.Sprintf("%d", uid))
-	if err = u.Write(userDir, user); err != nil {
-		user.Status = old_status
+	u.refreshLock.Lock()
+	defer u.refreshLock.Unlock()
+
+	//Maybe refreshed by another goroutine
+	if stoken, err = u.getStravaToken(uid); err != nil {
+		return
+	}
+	if stravaTokenValid(&stoken) {
+		token = stoken.AccessToken
+		return
+	}
+
+	new_token, err := stravaRefresh(stoken.RefreshToken)
+	if err != nil {
+		slog.Error("GetToken stravaRefresh", "uid", uid, "err", err)
+		err = errors.New("刷新Strava令牌出错:" + err.Error())
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	user.AccessToken = new_token.AccessToken
+	user.RefreshToken = new_token.RefreshToken
+	user.ExpiresAt = new_token.ExpiresAt
+	if err = u.Write(uid, user); err != nil {
+		//The new token can still be used this time
+		slog.Error("GetToken u.Write", "uid", uid, "err", err)
+		err = nil
+	}
+
+	token = new_token.AccessToken
+	return
+}
+
+//Get the API token of uid.  A new token will be created if uid doesn't
+//have one or renew is true.
+func (u *UserMap) GetApiToken(uid uint64, renew bool) (token string, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	if user.ApiToken != "" && !renew {
+		token = user.ApiToken
+		return
+	}
+
+	if token, err = randomHex(32); err != nil {
+		return
+	}
+	old_token := user.ApiToken
+	user.ApiToken = token
+	if err = u.Write(uid, user); err != nil {
+		user.ApiToken = old_token
 		return
 	}
+	delete(u.apitoken2uid, old_token)
+	u.apitoken2uid[token] = uid
+
+	return
+}
+
+func (u *UserMap) CheckApiToken(token string) (uid uint64, ok bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
 
+	uid, ok = u.apitoken2uid[token]
 	return
 }
 
-func (u *UserMap) GetUserMakeVideoFailReason(uid uint64) (reason string) {
+func (u *UserMap) GetUserStatus(uid uint64) (status int, err error) {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
 	user, ok := u.uid2user[uid]
 	if !ok {
-		reason = ""
+		err = fmt.Errorf("查找客户%d失败", uid)
 		return
 	}
 
-	reason = user.MakeVideoFailReason
+	status = user.Status
 	return
 }
+
+//fail is only used when status is UserMakeVideoFail
+func (u *UserMap) SetUserStatus(uid uint64, status int, options *MakeVideoOptions, fail *FailInfo) (err error) {
+	if err = u.setUserStatus(uid, status, options, fail); err != nil {
+		return
+	}
+	events.PublishStatus(uid, status)
+	return
+}
+
+func (u *UserMap) setUserStatus(uid uint64, status int, options *MakeVideoOptions, fail *FailInfo) (err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	if status < UserNormal || status >= userStatusNum {
+		err = fmt.Errorf("设置客户%d状态%d失败", uid, status)
+		return
+	}
+
+	if status == UserMakeVideoFail && fail == nil {
+		fail = &FailInfo{Kind: FailUnknown, Reason: failKindInfo[FailUnknown]}
+	}
+	//The waiting status can keep why the video is made again
+	if fail == nil || (status != UserMakeVideoFail && status != UserWaitingVideo) {
+		fail = &FailInfo{}
+	}
+
+	old_status := user.Status
+	old_reason := user.MakeVideoFailReason
+	old_kind := user.MakeVideoFailKind
+	old_moptions := user.Moptions
+	user.Status = status
+	user.MakeVideoFailReason = fail.Reason
+	user.MakeVideoFailKind = fail.Kind
+
+	if options != nil {
+		user.Moptions = *options
+	}
+
+	//Sync the status of the video that is made by the current job
+	var video *Video
+	var old_video Video
+	if i := user.findVideo(user.Moptions.VideoId); i >= 0 {
+		video = user.Videos[i]
+		old_video = *video
+		video.syncStatus(status, fail)
+	}
+
+	if err = u.Write(uid, user); err != nil {
+		user.Status = old_status
+		user.MakeVideoFailReason = old_reason
+		user.MakeVideoFailKind = old_kind
+		user.Moptions = old_moptions
+		if video != nil {
+			*video = old_video
+		}
+		return
+	}
+
+	return
+}
+
+//Set the status of video vid that is made by a job.  The status of uid is
+//only changed if vid is still the current video of uid, so an old job
+//doesn't change the status of the new one.
+func (u *UserMap) SetJobStatus(uid uint64, vid uint64, status int, fail *FailInfo) (err error) {
+	var current bool
+	if current, err = u.setJobStatus(uid, vid, status, fail); err != nil || !current {
+		return
+	}
+	events.PublishStatus(uid, status)
+	return
+}
+
+func (u *UserMap) setJobStatus(uid uint64, vid uint64, status int, fail *FailInfo) (current bool, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	if status < UserNormal || status >= userStatusNum {
+		err = fmt.Errorf("设置客户%d状态%d失败", uid, status)
+		return
+	}
+
+	if status == UserMakeVideoFail && fail == nil {
+		fail = &FailInfo{Kind: FailUnknown, Reason: failKindInfo[FailUnknown]}
+	}
+	//The waiting status can keep why the video is made again
+	if fail == nil || (status != UserMakeVideoFail && status != UserWaitingVideo) {
+		fail = &FailInfo{}
+	}
+
+	current = user.Moptions.VideoId == vid
+	if status == UserMakingVideo && (!current || user.Status != UserWaitingVideo) {
+		err = fmt.Errorf("客户%d的视频%d不在等待生成", uid, vid)
+		return
+	}
+
+	old_status := user.Status
+	old_reason := user.MakeVideoFailReason
+	old_kind := user.MakeVideoFailKind
+	if current {
+		user.Status = status
+		user.MakeVideoFailReason = fail.Reason
+		user.MakeVideoFailKind = fail.Kind
+	}
+
+	var video *Video
+	var old_video Video
+	if i := user.findVideo(vid); i >= 0 {
+		video = user.Videos[i]
+		old_video = *video
+		video.syncStatus(status, fail)
+	}
+
+	//Only a video that is made successfully takes the place of the old ones
+	old_videos := user.Videos
+	var removed []uint64
+	if video != nil && video.Status == VideoSuccess && old_video.Status != VideoSuccess {
+		user.Videos, removed = user.pruneVideos(vid)
+	}
+
+	if err = u.Write(uid, user); err != nil {
+		user.Status = old_status
+		user.MakeVideoFailReason = old_reason
+		user.MakeVideoFailKind = old_kind
+		user.Videos = old_videos
+		if video != nil {
+			*video = old_video
+		}
+		return
+	}
+
+	for _, id := range removed {
+		os.RemoveAll(u.VideoDir(uid, id))
+	}
+	return
+}
+
+//Set the status of the video to follow the status of the user that makes it
+func (video *Video) syncStatus(status int, fail *FailInfo) {
+	switch status {
+	case UserWaitingVideo:
+		video.Status = VideoWaiting
+		video.FailKind = fail.Kind
+		video.FailReason = fail.Reason
+	case UserMakingVideo:
+		video.Status = VideoMaking
+		video.FailKind = ""
+		video.FailReason = ""
+	case UserMakeVideoFail:
+		video.Status = VideoFail
+		video.FailKind = fail.Kind
+		video.FailReason = fail.Reason
+		video.FailTail = fail.Tail
+	case UserMakeVideoCancel:
+		video.Status = VideoCancel
+	case UserNormal:
+		if video.Status == VideoMaking {
+			video.Status = VideoSuccess
+		}
+	}
+}
+
+//The state of a user before StartJob, used by AbortJob
+type JobRollback struct {
+	status   int
+	reason   string
+	kind     string
+	moptions MakeVideoOptions
+	video    Video
+}
+
+//Mark uid waiting for the job that makes video options.VideoId.  It fails
+//if uid already has a job, so only one request can add a job of uid.
+//Call AbortJob with rollback if the job cannot be added to the queue.
+func (u *UserMap) StartJob(uid uint64, options *MakeVideoOptions) (rollback *JobRollback, err error) {
+	if rollback, err = u.startJob(uid, options); err != nil {
+		return
+	}
+	events.PublishStatus(uid, UserWaitingVideo)
+	return
+}
+
+func (u *UserMap) startJob(uid uint64, options *MakeVideoOptions) (rollback *JobRollback, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	if user.Status == UserMakingVideo || user.Status == UserWaitingVideo {
+		err = errors.New("正在生成一个视频")
+		return
+	}
+	i := user.findVideo(options.VideoId)
+	if i < 0 {
+		err = fmt.Errorf("没有视频%d", options.VideoId)
+		return
+	}
+	video := user.Videos[i]
+
+	old := &JobRollback{
+		status:   user.Status,
+		reason:   user.MakeVideoFailReason,
+		kind:     user.MakeVideoFailKind,
+		moptions: user.Moptions,
+		video:    *video,
+	}
+	user.Status = UserWaitingVideo
+	user.MakeVideoFailReason = ""
+	user.MakeVideoFailKind = ""
+	user.Moptions = *options
+	video.Status = VideoWaiting
+
+	if err = u.Write(uid, user); err != nil {
+		old.restore(user, video)
+		return
+	}
+	rollback = old
+	return
+}
+
+func (rollback *JobRollback) restore(user *User, video *Video) {
+	user.Status = rollback.status
+	user.MakeVideoFailReason = rollback.reason
+	user.MakeVideoFailKind = rollback.kind
+	user.Moptions = rollback.moptions
+	if video != nil {
+		*video = rollback.video
+	}
+}
+
+//Undo StartJob of video vid.  Nothing is changed if the state of uid was
+//changed by the others after StartJob.
+func (u *UserMap) AbortJob(uid uint64, vid uint64, rollback *JobRollback) (err error) {
+	var changed bool
+	if changed, err = u.abortJob(uid, vid, rollback); err != nil || !changed {
+		return
+	}
+	events.PublishStatus(uid, rollback.status)
+	return
+}
+
+func (u *UserMap) abortJob(uid uint64, vid uint64, rollback *JobRollback) (changed bool, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	if user.Status != UserWaitingVideo || user.Moptions.VideoId != vid {
+		return
+	}
+
+	var video *Video
+	if i := user.findVideo(vid); i >= 0 {
+		video = user.Videos[i]
+	}
+	current := &JobRollback{
+		status:   user.Status,
+		reason:   user.MakeVideoFailReason,
+		kind:     user.MakeVideoFailKind,
+		moptions: user.Moptions,
+	}
+	if video != nil {
+		current.video = *video
+	}
+	rollback.restore(user, video)
+	if err = u.Write(uid, user); err != nil {
+		current.restore(user, video)
+		return
+	}
+	changed = true
+	return
+}
+
+//Add a new video to the list of user uid and create its directory.
+func (u *UserMap) AddVideo(uid uint64, trackId int64, name string) (vid uint64, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+
+	if err = dir_check_creat(filepath.Join(u.UserDir(uid), "videos"), true); err != nil {
+		return
+	}
+	vid = user.LastVideoId + 1
+	video_dir := u.VideoDir(uid, vid)
+	if err = os.RemoveAll(video_dir); err != nil {
+		return
+	}
+	if err = os.Mkdir(video_dir, os.FileMode(0700)); err != nil {
+		return
+	}
+
+	old_videos := user.Videos
+	old_last := user.LastVideoId
+	user.LastVideoId = vid
+	user.Videos = append(append([]*Video{}, user.Videos...), &Video{
+		Id:        vid,
+		TrackId:   trackId,
+		Name:      name,
+		CreatedAt: time.Now(),
+		Status:    VideoWaiting,
+	})
+
+	if err = u.Write(uid, user); err != nil {
+		user.Videos = old_videos
+		user.LastVideoId = old_last
+		os.RemoveAll(video_dir)
+		return
+	}
+
+	return
+}
+
+func (u *UserMap) DelVideo(uid uint64, vid uint64) (err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+
+	i := user.findVideo(vid)
+	if i < 0 {
+		err = fmt.Errorf("查找视频%d失败", vid)
+		return
+	}
+	if user.videoBusy(vid) {
+		err = errors.New("视频正在生成中")
+		return
+	}
+
+	old_videos := user.Videos
+	user.Videos = append(append([]*Video{}, user.Videos[:i]...), user.Videos[i+1:]...)
+	if err = u.Write(uid, user); err != nil {
+		user.Videos = old_videos
+		return
+	}
+
+	err = os.RemoveAll(u.VideoDir(uid, vid))
+	return
+}
+
+func (u *UserMap) GetVideos(uid uint64) (videos []Video) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		return
+	}
+
+	for _, video := range user.Videos {
+		videos = append(videos, *video)
+	}
+	return
+}
+
+func (u *UserMap) GetUserMakeVideoFail(uid uint64) (kind string, reason string) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		return
+	}
+
+	kind = user.MakeVideoFailKind
+	reason = user.MakeVideoFailReason
+	return
+}
+
+//The information of a user that is shown to the administrator
+type UserInfo struct {
+	Uid        uint64
+	AthleteId  int64
+	Username   string
+	Status     int
+	FailKind   string
+	FailReason string
+	LastActive time.Time
+	Videos     []Video
+
+	//Only for the local accounts
+	EmailVerified bool
+	VerifyExpires time.Time
+}
+
+//Get the information of all users, sorted by uid
+func (u *UserMap) List() (infos []UserInfo) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	for uid, user := range u.uid2user {
+		info := UserInfo{
+			Uid:        uid,
+			AthleteId:  user.AthleteId,
+			Username:   user.Username,
+			Status:     user.Status,
+			FailKind:   user.MakeVideoFailKind,
+			FailReason: user.MakeVideoFailReason,
+			LastActive: user.LastActive,
+
+			EmailVerified: user.EmailVerified,
+			VerifyExpires: user.VerifyExpires,
+		}
+		for _, video := range user.Videos {
+			info.Videos = append(info.Videos, *video)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Uid < infos[j].Uid })
+	return
+}
+
+func (u *UserMap) GetAthleteId(uid uint64) (athleteId int64, err error) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	athleteId = user.AthleteId
+	return
+}
+
+//Get the options to make failed video vid again.  Only the video of the
+//last job can be made again because the options of the other videos are
+//not kept.
+func (u *UserMap) GetRerunOptions(uid uint64, vid uint64) (options MakeVideoOptions, err error) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	user, ok := u.uid2user[uid]
+	if !ok {
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	if user.Status == UserMakingVideo || user.Status == UserWaitingVideo {
+		err = errors.New("正在生成一个视频")
+		return
+	}
+	i := user.findVideo(vid)
+	if i < 0 {
+		err = fmt.Errorf("没有视频%d", vid)
+		return
+	}
+	if user.Videos[i].Status != VideoFail && user.Videos[i].Status != VideoCancel {
+		err = errors.New("只能重新生成失败或者取消的视频")
+		return
+	}
+	if user.Moptions.VideoId != vid {
+		err = errors.New("只能重新生成最后一个视频")
+		return
+	}
+
+	options = user.Moptions
+	return
+}
+
+//Delete user uid and all the files of it
+func (u *UserMap) Delete(uid uint64) (err error) {
+	u.lock.Lock()
+	user, ok := u.uid2user[uid]
+	if !ok {
+		u.lock.Unlock()
+		err = fmt.Errorf("查找客户%d失败", uid)
+		return
+	}
+	if user.Status == UserMakingVideo || user.Status == UserWaitingVideo {
+		u.lock.Unlock()
+		err = errors.New("正在生成视频，请先取消")
+		return
+	}
+	if err = u.store.Delete(uid); err != nil {
+		u.lock.Unlock()
+		return
+	}
+	delete(u.uid2user, uid)
+	if got_uid, ok := u.token2uid[user.Token]; ok && got_uid == uid {
+		delete(u.token2uid, user.Token)
+	}
+	if got_uid, ok := u.athlete2uid[user.AthleteId]; ok && got_uid == uid {
+		delete(u.athlete2uid, user.AthleteId)
+	}
+	if user.ApiToken != "" {
+		delete(u.apitoken2uid, user.ApiToken)
+	}
+	if user.Username != "" {
+		delete(u.username2uid, user.Username)
+	}
+	u.lock.Unlock()
+
+	sessions.DeleteUid(uid)
+	activityCache.Delete(uid)
+	if err = os.RemoveAll(u.UserDir(uid)); err != nil {
+		slog.Error("UserMap Delete os.RemoveAll", "uid", uid, "err", err)
+		err = nil
+	}
+	return
+}
+
+//Record that uid is active
+func (u *UserMap) Touch(uid uint64) {
+	u.lock.RLock()
+	user, ok := u.uid2user[uid]
+	need := ok && time.Since(user.LastActive) > time.Hour
+	u.lock.RUnlock()
+	if !need {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if user, ok = u.uid2user[uid]; !ok {
+		return
+	}
+	old_active := user.LastActive
+	user.LastActive = time.Now()
+	if err := u.Write(uid, user); err != nil {
+		slog.Error("Touch u.Write", "uid", uid, "err", err)
+		user.LastActive = old_active
+	}
+}
+
+//Number of the users in each status
+func (u *UserMap) StatusCount() (count []int) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	count = make([]int, userStatusNum)
+	for _, user := range u.uid2user {
+		if user.Status >= UserNormal && user.Status < userStatusNum {
+			count[user.Status]++
+		}
+	}
+	return
+}
+
+//Close the store, must be called after all the other goroutines stop
+//using u
+func (u *UserMap) Close() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if err := u.store.Close(); err != nil {
+		slog.Error("UserMap Close u.store.Close", "err", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func testVideoIds(uid uint64) (ids []uint64) {
+	for _, video := range users.GetVideos(uid) {
+		ids = append(ids, video.Id)
+	}
+	return
+}
+
+//The old videos are only removed when a new one is made successfully
+func TestSetJobStatusPrune(t *testing.T) {
+	testJobQueue(t)
+	serverConf.MaxVideos = 2
+
+	uid, vid1 := testWaitingUser(t, 1)
+	if err := users.SetJobStatus(uid, vid1, UserNormal, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		want   func(vid uint64) []uint64
+	}{
+		{"success", UserNormal, func(vid uint64) []uint64 { return []uint64{vid1, vid} }},
+		{"fail", UserMakeVideoFail, func(vid uint64) []uint64 { return []uint64{vid1, vid - 1, vid} }},
+		{"cancel", UserMakeVideoCancel, func(vid uint64) []uint64 { return []uint64{vid1, vid - 2, vid - 1, vid} }},
+		{"success removes the oldest", UserNormal, func(vid uint64) []uint64 { return []uint64{vid - 1, vid} }},
+	}
+	for _, test := range tests {
+		vid, err := users.AddVideo(uid, 1, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = users.StartJob(uid, &MakeVideoOptions{VideoId: vid}); err != nil {
+			t.Fatal(err)
+		}
+		if err = users.SetJobStatus(uid, vid, UserMakingVideo, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = users.SetJobStatus(uid, vid, test.status, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := testVideoIds(uid), test.want(vid); !testSameUids(got, want) {
+			t.Errorf("%s: videos = %v, want %v", test.name, got, want)
+		}
+	}
+
+	if _, err := os.Stat(users.VideoDir(uid, vid1)); !os.IsNotExist(err) {
+		t.Errorf("directory of the removed video: %v", err)
+	}
+}
+
+//The interrupted job is waiting again and keeps why it is made again
+func TestSetJobStatusInterrupted(t *testing.T) {
+	testJobQueue(t)
+	uid, vid := testWaitingUser(t, 1)
+	interrupted := &FailInfo{Kind: FailInterrupted, Reason: failKindInfo[FailInterrupted]}
+
+	tests := []struct {
+		name   string
+		status int
+		fail   *FailInfo
+		want   string
+	}{
+		{"making", UserMakingVideo, nil, ""},
+		{"interrupted", UserWaitingVideo, interrupted, FailInterrupted},
+		{"making again", UserMakingVideo, nil, ""},
+		{"success", UserNormal, nil, ""},
+	}
+	for _, test := range tests {
+		if err := users.SetJobStatus(uid, vid, test.status, test.fail); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		kind, _ := users.GetUserMakeVideoFail(uid)
+		var video_kind string
+		for _, video := range users.GetVideos(uid) {
+			if video.Id == vid {
+				video_kind = video.FailKind
+			}
+		}
+		if kind != test.want || video_kind != test.want {
+			t.Errorf("%s: fail kind of the user %q and the video %q, want %q", test.name, kind, video_kind, test.want)
+		}
+	}
+}
+
+//The verification email is not sent again too often and the local
+//account that is not verified in time is removed by the janitor
+func TestLocalVerify(t *testing.T) {
+	testJobQueue(t)
+	uid, err := users.AddLocal("test", "test@example.com", "hash", verifyTokenHash("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = users.SetVerifyHash(uid, verifyTokenHash("token2")); err != errVerifyResend {
+		t.Errorf("SetVerifyHash just after AddLocal = %v, want errVerifyResend", err)
+	}
+	users.uid2user[uid].VerifyExpires = time.Now().Add(localVerifyAge - localVerifyResend)
+	if err = users.SetVerifyHash(uid, verifyTokenHash("token2")); err != nil {
+		t.Errorf("SetVerifyHash after localVerifyResend = %v", err)
+	}
+	if err = users.VerifyEmail(uid, verifyTokenHash("token")); err == nil {
+		t.Error("VerifyEmail with the old token, want an error")
+	}
+
+	janitor()
+	if _, _, _, _, err = users.GetLocal("test"); err != nil {
+		t.Fatalf("the account is removed before it expires: %v", err)
+	}
+
+	users.uid2user[uid].VerifyExpires = time.Now().Add(-time.Second)
+	janitor()
+	if _, _, _, _, err = users.GetLocal("test"); err == nil {
+		t.Error("the expired account is not removed")
+	}
+	if _, err = users.AddLocal("test", "test@example.com", "hash", ""); err != nil {
+		t.Errorf("AddLocal with the username of the removed account: %v", err)
+	}
+}
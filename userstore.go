@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//UserStore keeps the User records of UserMap.  UserMap holds the lock when
+//it calls them.
+type UserStore interface {
+	//Call fn with each user
+	Load(fn func(uid uint64, user *User)) error
+	Put(uid uint64, user *User) error
+	Delete(uid uint64) error
+	Close() error
+}
+
+func newUserStore(dir string) (store UserStore, err error) {
+	switch serverConf.UserStore {
+	case "bolt":
+		store, err = NewBoltUserStore(dir)
+	case "gob":
+		store = &GobUserStore{dir: dir}
+	default:
+		err = fmt.Errorf("UserStore %s is not supported", serverConf.UserStore)
+	}
+	return
+}
+
+func readUserGob(file string) (user *User, err error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	dec := gob.NewDecoder(fd)
+	user = new(User)
+	if err = dec.Decode(user); err != nil {
+		user = nil
+	}
+	return
+}
+
+//Call fn with each WorkDir/<uid>
+func walkUserDirs(dir string, fn func(uid uint64, userDir string)) error {
+	return filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return err
+		}
+		if !f.IsDir() || path == dir {
+			return nil
+		}
+
+		match, err := filepath.Match(`[0-9]*`, f.Name())
+		if err == nil && match {
+			uid, err := strconv.ParseUint(f.Name(), 10, 64)
+			if err != nil {
+				slog.Warn("walkUserDirs strconv.ParseUint", "dir", path, "err", err)
+				return filepath.SkipDir
+			}
+			fn(uid, path)
+		}
+		return filepath.SkipDir
+	})
+}
+
+//Move the directory of the user that cannot be loaded to
+//WorkDir/quarantine/<uid>-<time>.  The record is written to it if data is
+//not nil.  The administrator can check them and get the videos back.
+func quarantineUser(dir string, uid uint64, data []byte) (err error) {
+	quarantine_dir := filepath.Join(dir, "quarantine")
+	if err = dir_check_creat(quarantine_dir, false); err != nil {
+		slog.Error("quarantineUser dir_check_creat", "uid", uid, "err", err)
+		return
+	}
+	dst := filepath.Join(quarantine_dir, fmt.Sprintf("%d-%s", uid, time.Now().Format("20060102150405")))
+	src := filepath.Join(dir, fmt.Sprintf("%d", uid))
+	if err = os.Rename(src, dst); err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("quarantineUser os.Rename", "uid", uid, "err", err)
+			return
+		}
+		if err = os.Mkdir(dst, 0700); err != nil {
+			slog.Error("quarantineUser os.Mkdir", "uid", uid, "err", err)
+			return
+		}
+	}
+	if data != nil {
+		if err = os.WriteFile(filepath.Join(dst, "user.json"), data, 0600); err != nil {
+			slog.Error("quarantineUser os.WriteFile", "uid", uid, "err", err)
+			return
+		}
+	}
+	slog.Warn("quarantineUser", "uid", uid, "dir", dst)
+	return
+}
+
+//Each user is saved to WorkDir/<uid>/user.gob
+type GobUserStore struct {
+	dir string
+}
+
+func (s *GobUserStore) file(uid uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d", uid), "user.gob")
+}
+
+func (s *GobUserStore) Load(fn func(uid uint64, user *User)) error {
+	return walkUserDirs(s.dir, func(uid uint64, userDir string) {
+		user, err := readUserGob(s.file(uid))
+		if err != nil {
+			slog.Error("GobUserStore Load readUserGob", "uid", uid, "err", err)
+			quarantineUser(s.dir, uid, nil)
+			return
+		}
+		fn(uid, user)
+	})
+}
+
+func (s *GobUserStore) Put(uid uint64, user *User) error {
+	return writeFileAtomic(s.file(uid), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(user)
+	})
+}
+
+func (s *GobUserStore) Delete(uid uint64) error {
+	err := os.Remove(s.file(uid))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+func (s *GobUserStore) Close() error {
+	return nil
+}
+
+var (
+	boltMetaBucket  = []byte("meta")
+	boltUsersBucket = []byte("users")
+	boltVersionKey  = []byte("version")
+)
+
+//All users are saved to WorkDir/users.db.  The key is uid and the value is
+//the JSON of User.
+type BoltUserStore struct {
+	db *bolt.DB
+
+	dir string
+}
+
+//The migrations of the database.  The version in the meta bucket is the
+//number of migrations that have been done.  Only append to it.
+var boltMigrations = []func(s *BoltUserStore, tx *bolt.Tx) error{
+	//1: Create the buckets
+	func(s *BoltUserStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltUsersBucket)
+		return err
+	},
+	//2: Import the user.gob files of old versions
+	func(s *BoltUserStore, tx *bolt.Tx) error {
+		return s.importGob(tx)
+	},
+}
+
+func NewBoltUserStore(dir string) (s *BoltUserStore, err error) {
+	db, err := bolt.Open(filepath.Join(dir, "users.db"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+	s = &BoltUserStore{db: db, dir: dir}
+	if err = s.migrate(); err != nil {
+		db.Close()
+		s = nil
+	}
+	return
+}
+
+func (s *BoltUserStore) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		var version uint64
+		if v := meta.Get(boltVersionKey); v != nil {
+			if len(v) != 8 {
+				return errors.New("version of users.db is not right")
+			}
+			version = binary.BigEndian.Uint64(v)
+		}
+		if version > uint64(len(boltMigrations)) {
+			return fmt.Errorf("version %d of users.db is newer than this program", version)
+		}
+
+		for ; version < uint64(len(boltMigrations)); version++ {
+			slog.Info("BoltUserStore migrate", "version", version+1)
+			if err = boltMigrations[version](s, tx); err != nil {
+				return fmt.Errorf("migrate to version %d: %s", version+1, err)
+			}
+		}
+
+		return meta.Put(boltVersionKey, boltKey(version))
+	})
+}
+
+//Read WorkDir/<uid>/user.gob to the database.  The files are kept as the
+//backup.  The user that cannot be read is quarantined like Load does.
+func (s *BoltUserStore) importGob(tx *bolt.Tx) error {
+	b := tx.Bucket(boltUsersBucket)
+	var put_err error
+	var bad []uint64
+	err := walkUserDirs(s.dir, func(uid uint64, userDir string) {
+		if put_err != nil {
+			return
+		}
+		file := filepath.Join(userDir, "user.gob")
+		user, err := readUserGob(file)
+		if err != nil {
+			slog.Error("BoltUserStore importGob readUserGob", "uid", uid, "file", file, "err", err)
+			bad = append(bad, uid)
+			return
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			put_err = err
+			return
+		}
+		put_err = b.Put(boltKey(uid), data)
+		slog.Info("BoltUserStore importGob", "uid", uid)
+	})
+	if err != nil {
+		return err
+	}
+	if put_err != nil {
+		return put_err
+	}
+
+	//Don't move the directories while walking them
+	for _, uid := range bad {
+		quarantineUser(s.dir, uid, nil)
+	}
+	return nil
+}
+
+func boltKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func (s *BoltUserStore) Load(fn func(uid uint64, user *User)) error {
+	//fn might call Put, so call it after the read transaction
+	var uids []uint64
+	loaded := make(map[uint64]*User)
+	bad := make(map[uint64][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			if len(k) != 8 {
+				return nil
+			}
+			uid := binary.BigEndian.Uint64(k)
+			user := new(User)
+			if err := json.Unmarshal(v, user); err != nil {
+				slog.Error("BoltUserStore Load json.Unmarshal", "uid", uid, "err", err)
+				bad[uid] = append([]byte{}, v...)
+				return nil
+			}
+			uids = append(uids, uid)
+			loaded[uid] = user
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for uid, data := range bad {
+		if quarantineUser(s.dir, uid, data) != nil {
+			continue
+		}
+		if err = s.Delete(uid); err != nil {
+			slog.Error("BoltUserStore Load s.Delete", "uid", uid, "err", err)
+		}
+	}
+
+	for _, uid := range uids {
+		fn(uid, loaded[uid])
+	}
+	return nil
+}
+
+func (s *BoltUserStore) Put(uid uint64, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).Put(boltKey(uid), data)
+	})
+}
+
+func (s *BoltUserStore) Delete(uid uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).Delete(boltKey(uid))
+	})
+}
+
+func (s *BoltUserStore) Close() error {
+	return s.db.Close()
+}
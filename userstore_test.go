@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Write user to dir/<uid>/user.gob like the old versions
+func testWriteUserGob(t *testing.T, dir string, uid string, user *User) {
+	user_dir := filepath.Join(dir, uid)
+	if err := os.Mkdir(user_dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Create(filepath.Join(user_dir, "user.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err = gob.NewEncoder(fd).Encode(user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testLoadUsers(t *testing.T, s UserStore) map[uint64]*User {
+	loaded := make(map[uint64]*User)
+	if err := s.Load(func(uid uint64, user *User) {
+		loaded[uid] = user
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+func TestBoltUserStoreImportGob(t *testing.T) {
+	dir := t.TempDir()
+	testWriteUserGob(t, dir, "1", &User{Token: "a", AthleteId: 11, Videos: []*Video{{Id: 1, Status: VideoSuccess}}, LastVideoId: 1})
+	testWriteUserGob(t, dir, "2", &User{Token: "b", Status: UserMakeVideoFail, MakeVideoFailReason: "x"})
+	//Cannot be decoded
+	if err := os.Mkdir(filepath.Join(dir, "3"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "3", "user.gob"), []byte("not gob"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	//Doesn't have user.gob
+	if err := os.Mkdir(filepath.Join(dir, "4"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	//Not a user
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewBoltUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := testLoadUsers(t, s)
+	if len(loaded) != 2 {
+		t.Fatalf("loaded %d users, want 2", len(loaded))
+	}
+	if user := loaded[1]; user == nil || user.Token != "a" || user.AthleteId != 11 || len(user.Videos) != 1 || user.Videos[0].Status != VideoSuccess {
+		t.Errorf("user 1 = %+v", user)
+	}
+	if user := loaded[2]; user == nil || user.Status != UserMakeVideoFail || user.MakeVideoFailReason != "x" {
+		t.Errorf("user 2 = %+v", user)
+	}
+
+	//The files are kept as the backup
+	if _, err := os.Stat(filepath.Join(dir, "1", "user.gob")); err != nil {
+		t.Error(err)
+	}
+	//The users that cannot be read are quarantined
+	for _, uid := range []string{"3", "4"} {
+		if _, err := os.Stat(filepath.Join(dir, uid)); !os.IsNotExist(err) {
+			t.Errorf("directory of user %s is not moved: %v", uid, err)
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, "quarantine", uid+"-*"))
+		if len(matches) != 1 {
+			t.Errorf("user %s in quarantine: %v", uid, matches)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); err != nil {
+		t.Error(err)
+	}
+
+	//The import is only done once
+	if err = s.Put(1, &User{Token: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testWriteUserGob(t, dir, "5", &User{Token: "d"})
+	if s, err = NewBoltUserStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	loaded = testLoadUsers(t, s)
+	if len(loaded) != 2 || loaded[1] == nil || loaded[1].Token != "c" {
+		t.Errorf("loaded after reopen = %+v", loaded)
+	}
+}